@@ -12,6 +12,7 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-unixfsnode/data/builder"
 	carv1 "github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
 	"github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	carstorage "github.com/ipld/go-car/v2/storage"
@@ -20,21 +21,25 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
+	"github.com/utopiosphe/titan-storage-sdk/client"
 )
 
-// createCar creates a car
-func createCar(input string, output string) (cid.Cid, error) {
-	// make a cid with the right length that we eventually will patch with the root.
-	hasher, err := multihash.GetHasher(multihash.SHA2_256)
-	if err != nil {
-		return cid.Cid{}, err
-	}
-	digest := hasher.Sum([]byte{})
-	hash, err := multihash.Encode(digest, multihash.SHA2_256)
+// createCar creates a car, the dag is built with the default builder if dag is nil
+func createCar(input string, output string, dag *DagOptions) (cid.Cid, error) {
+	return writeCar(output, true, []string{path.Base(input)}, []string{input}, dag)
+}
+
+// createWrappedCar creates a car of a directory holding every path under the name at the same index
+func createWrappedCar(names, paths []string, output string, dag *DagOptions) (cid.Cid, error) {
+	return writeCar(output, false, names, paths, dag)
+}
+
+// writeCar writes the unixfs dag of paths into the car output
+func writeCar(output string, noWrap bool, names, paths []string, dag *DagOptions) (cid.Cid, error) {
+	proxyRoot, err := newProxyRoot(dag)
 	if err != nil {
 		return cid.Cid{}, err
 	}
-	proxyRoot := cid.NewCidV1(uint64(multicodec.DagPb), hash)
 
 	cdest, err := blockstore.OpenReadWrite(output, []cid.Cid{proxyRoot})
 	if err != nil {
@@ -42,7 +47,18 @@ func createCar(input string, output string) (cid.Cid, error) {
 	}
 
 	// Write the unixfs blocks into the store.
-	root, err := writeFiles(context.TODO(), true, cdest, input)
+	var root cid.Cid
+	if dag != nil {
+		root, err = dag.buildPaths(context.TODO(), noWrap, names, paths, func(c cid.Cid, data []byte) error {
+			blk, err := blocks.NewBlockWithCid(data, c)
+			if err != nil {
+				return err
+			}
+			return cdest.Put(context.TODO(), blk)
+		})
+	} else {
+		root, err = writeFiles(context.TODO(), noWrap, cdest, names, paths...)
+	}
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -54,8 +70,21 @@ func createCar(input string, output string) (cid.Cid, error) {
 	return root, car.ReplaceRootsInFile(output, []cid.Cid{root})
 }
 
+// newProxyRoot makes a cid with the length of the root built with dag, that we eventually will patch with the root.
+func newProxyRoot(dag *DagOptions) (cid.Cid, error) {
+	prefix := cid.Prefix{Version: 1, Codec: uint64(multicodec.DagPb), MhType: multihash.SHA2_256, MhLength: -1}
+	if dag != nil {
+		if err := dag.validate(); err != nil {
+			return cid.Cid{}, err
+		}
+		prefix = dag.prefix()
+	}
+	return prefix.Sum([]byte{})
+}
+
 // writeFiles writes files to the blockstore and returns the root CID.
-func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, paths ...string) (cid.Cid, error) {
+// Unless noWrap is set, the paths are wrapped in a directory under the name at the same index.
+func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, names []string, paths ...string) (cid.Cid, error) {
 	ls := cidlink.DefaultLinkSystem()
 	ls.TrustedStorage = true
 	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
@@ -80,13 +109,12 @@ func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, path
 			if err != nil {
 				return err
 			}
-			bs.Put(ctx, blk)
-			return nil
+			return bs.Put(ctx, blk)
 		}, nil
 	}
 
 	topLevel := make([]dagpb.PBLink, 0, len(paths))
-	for _, p := range paths {
+	for i, p := range paths {
 		l, size, err := builder.BuildUnixFSRecursive(p, &ls)
 		if err != nil {
 			return cid.Undef, err
@@ -98,8 +126,7 @@ func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, path
 			}
 			return rcl.Cid, nil
 		}
-		name := path.Base(p)
-		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), l)
+		entry, err := builder.BuildUnixFSDirectoryEntry(names[i], int64(size), l)
 		if err != nil {
 			return cid.Undef, err
 		}
@@ -110,7 +137,7 @@ func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, path
 
 	root, _, err := builder.BuildUnixFSDirectory(topLevel, &ls)
 	if err != nil {
-		return cid.Undef, nil
+		return cid.Undef, err
 	}
 	rcl, ok := root.(cidlink.Link)
 	if !ok {
@@ -121,18 +148,89 @@ func writeFiles(ctx context.Context, noWrap bool, bs *blockstore.ReadWrite, path
 }
 
 // CalculateCid calculates the CID for the given reader.
-func CalculateCid(r io.Reader) (cid.Cid, error) {
+// The upload options that change the dag, like WithDagOptions, give the CID of an upload with the same options.
+func CalculateCid(r io.Reader, options ...RequestOption) (cid.Cid, error) {
+	opts := newRequestOptions(client.AssetProperty{}, options)
+	return buildFile(r, func(cid.Cid, []byte) error { return nil }, opts.dag)
+}
+
+// calculateCarV1 builds the unixfs dag of r without keeping any block,
+// and returns the root CID with the size of the CARv1 that writeCarV1 will produce for the same content.
+func calculateCarV1(r io.Reader, dag *DagOptions) (cid.Cid, int64, error) {
+	var (
+		size int64
+		seen = make(map[cid.Cid]struct{})
+	)
+
+	root, err := buildFile(r, func(c cid.Cid, data []byte) error {
+		if _, ok := seen[c]; ok {
+			return nil
+		}
+		seen[c] = struct{}{}
+		size += int64(util.LdSize(c.Bytes(), data))
+		return nil
+	}, dag)
+	if err != nil {
+		return cid.Cid{}, 0, err
+	}
+
+	headerSize, err := carv1.HeaderSize(&carv1.CarHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		return cid.Cid{}, 0, err
+	}
+
+	return root, size + int64(headerSize), nil
+}
+
+// writeCarV1 streams the CARv1 of r to w, blocks are written as soon as they are built.
+// The root is known from calculateCarV1, so the header can be written before any block,
+// an error is returned if the content does not produce the same root again.
+func writeCarV1(r io.Reader, root cid.Cid, w io.Writer, dag *DagOptions) error {
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: []cid.Cid{root}, Version: 1}, w); err != nil {
+		return err
+	}
+
+	seen := make(map[cid.Cid]struct{})
+	built, err := buildFile(r, func(c cid.Cid, data []byte) error {
+		if _, ok := seen[c]; ok {
+			return nil
+		}
+		seen[c] = struct{}{}
+		return util.LdWrite(w, c.Bytes(), data)
+	}, dag)
+	if err != nil {
+		return err
+	}
+
+	if !built.Equals(root) {
+		return fmt.Errorf("content changed while streaming car, root %s, expected %s", built.String(), root.String())
+	}
+
+	return nil
+}
+
+// buildFile builds the unixfs dag of r and passes every block to put, returns the root CID.
+// The dag is built with the default builder if dag is nil.
+func buildFile(r io.Reader, put func(c cid.Cid, data []byte) error, dag *DagOptions) (cid.Cid, error) {
+	if dag != nil {
+		return dag.buildFile(r, put)
+	}
+
 	ls := cidlink.DefaultLinkSystem()
 	ls.TrustedStorage = true
 
 	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
-		return nil, nil
+		return nil, fmt.Errorf("read block %s is not supported", l.String())
 	}
 
 	ls.StorageWriteOpener = func(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
 		buf := bytes.NewBuffer(nil)
 		return buf, func(l ipld.Link) error {
-			return nil
+			cl, ok := l.(cidlink.Link)
+			if !ok {
+				return fmt.Errorf("not a cidlink")
+			}
+			return put(cl.Cid, buf.Bytes())
 		}, nil
 	}
 
@@ -141,7 +239,10 @@ func CalculateCid(r io.Reader) (cid.Cid, error) {
 		return cid.Cid{}, err
 	}
 
-	root := link.(cidlink.Link)
+	root, ok := link.(cidlink.Link)
+	if !ok {
+		return cid.Cid{}, fmt.Errorf("could not interpret %s", link)
+	}
 	return root.Cid, nil
 }
 
@@ -154,22 +255,11 @@ type CarStream interface {
 }
 
 // createCarStream creates a car using a CarStream.
-func createCarStream(r io.Reader, carStream CarStream) (cid.Cid, error) {
-	// make a cid with the right length that we eventually will patch with the root.
-	hasher, err := multihash.GetHasher(multihash.SHA2_256)
+func createCarStream(r io.Reader, carStream CarStream, dag *DagOptions) (cid.Cid, error) {
+	proxyRoot, err := newProxyRoot(dag)
 	if err != nil {
 		return cid.Cid{}, err
 	}
-	digest := hasher.Sum([]byte{})
-	hash, err := multihash.Encode(digest, multihash.SHA2_256)
-	if err != nil {
-		return cid.Cid{}, err
-	}
-	proxyRoot := cid.NewCidV1(uint64(multicodec.DagPb), hash)
-	// proxyRoot, err := CalculateCID(r)
-	// if err != nil {
-	// 	return cid.Cid{}, err
-	// }
 
 	wCar, err := carstorage.NewWritable(carStream, []cid.Cid{proxyRoot})
 	if err != nil {
@@ -177,7 +267,7 @@ func createCarStream(r io.Reader, carStream CarStream) (cid.Cid, error) {
 	}
 
 	// Write the unixfs blocks into the store.
-	root, err := writeBuffer(context.TODO(), r, wCar)
+	root, err := writeBuffer(context.TODO(), r, wCar, dag)
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -190,8 +280,14 @@ func createCarStream(r io.Reader, carStream CarStream) (cid.Cid, error) {
 }
 
 // writeBuffer writes data to the car using a CarStream.
-func writeBuffer(ctx context.Context, r io.Reader, wCar carstorage.WritableCar) (cid.Cid, error) {
+func writeBuffer(ctx context.Context, r io.Reader, wCar carstorage.WritableCar, dag *DagOptions) (cid.Cid, error) {
 	sCar := wCar.(*carstorage.StorageCar)
+	if dag != nil {
+		return dag.buildFile(r, func(c cid.Cid, data []byte) error {
+			return sCar.Put(ctx, c.KeyString(), data)
+		})
+	}
+
 	ls := cidlink.DefaultLinkSystem()
 	ls.TrustedStorage = true
 
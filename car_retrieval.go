@@ -0,0 +1,438 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/file"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// carMediaType is the media type of a car response of a trustless gateway
+const carMediaType = "application/vnd.ipld.car"
+
+// WithCarRetrieval downloads the asset as a car instead of ranges of its content.
+// Every block is verified against its CID as it arrives and the file is reassembled locally,
+// so the content does not depend on the node serving it. The car is spooled to a temporary file removed on Close.
+// Readers only support file assets, DownloadToFile also writes folders as a directory tree.
+func WithCarRetrieval() DownloadOption {
+	return func(o *downloadOptions) {
+		o.car = true
+	}
+}
+
+// DownloadTrustless downloads the asset as a car, verifies every block and reassembles it at destPath,
+// a file for a file asset and a directory tree for a folder asset.
+// Encrypted files are decrypted, they cannot be downloaded without a KeyProvider.
+func (s *storage) DownloadTrustless(ctx context.Context, assetCID, destPath string) error {
+	dag, res, err := s.retrieveCar(ctx, assetCID)
+	if err != nil {
+		return err
+	}
+	defer dag.Close()
+
+	root, err := dag.load(ctx, dag.root)
+	if err != nil {
+		return err
+	}
+
+	if isDirectory(root) {
+		return writeDirectory(ctx, &dag.lsys, root, destPath, nil)
+	}
+
+	r, err := unixfsFileReader(ctx, &dag.lsys, root)
+	if err != nil {
+		return err
+	}
+
+	rc, err := s.decryptDownload(ctx, res.Encrypted, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return writeFileAt(destPath, rc)
+}
+
+// downloadCarFile returns the reassembled content of the file asset assetCID and its name
+func (s *storage) downloadCarFile(ctx context.Context, assetCID string) (io.ReadCloser, string, error) {
+	dag, res, err := s.retrieveCar(ctx, assetCID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	root, err := dag.load(ctx, dag.root)
+	if err != nil {
+		dag.Close()
+		return nil, "", err
+	}
+
+	if isDirectory(root) {
+		dag.Close()
+		return nil, "", fmt.Errorf("asset %s is a folder, use DownloadTrustless", assetCID)
+	}
+
+	rc, err := dag.file(ctx, root)
+	if err != nil {
+		dag.Close()
+		return nil, "", err
+	}
+
+	rc, err = s.decryptDownload(ctx, res.Encrypted, rc)
+	return rc, res.FileName, err
+}
+
+// retrieveCar downloads and verifies the car of assetCID from the first node that serves it, and reports the transfer.
+// It fails before downloading an encrypted asset that the storage cannot decrypt.
+func (s *storage) retrieveCar(ctx context.Context, assetCID string) (*carDag, *client.ShareAssetResult, error) {
+	root, err := cid.Decode(assetCID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := s.GetURL(ctx, assetCID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.checkDecryptable(assetCID, res); err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+
+	dag, err := fetchCar(ctx, s.getNodeClient(), res.URLs, root)
+
+	report := client.AssetTransferReq{
+		CostMs:       int64(time.Since(start).Milliseconds()),
+		TransferType: client.AssetTransferTypeDownload,
+		Cid:          assetCID,
+		State:        client.AssetTransferStateFailed,
+		TraceID:      res.TraceID,
+	}
+
+	if err == nil {
+		report.TotalSize = dag.size
+		report.State = client.AssetTransferStateSuccess
+	}
+
+	if reportErr := s.webAPI.AssetTransferReport(context.Background(), report); reportErr != nil {
+		log.Printf("failed to send transfer report, %s", reportErr.Error())
+	}
+
+	return dag, res, err
+}
+
+// fetchCar requests the car of root from the nodes of urls in turn, until one of them serves a valid car
+func fetchCar(ctx context.Context, httpClient *http.Client, urls []string, root cid.Cid) (*carDag, error) {
+	var dag *carDag
+	err := fetchFromNodes(ctx, httpClient, urls, root, "car", carMediaType, func(body io.Reader) (err error) {
+		dag, err = newCarDag(body, root)
+		return err
+	})
+	return dag, err
+}
+
+// fetchFromNodes requests c in format from the nodes of urls in turn, until read accepts the response of one of them
+func fetchFromNodes(ctx context.Context, httpClient *http.Client, urls []string, c cid.Cid, format, accept string, read func(body io.Reader) error) error {
+	var lastErr error
+
+	for _, v := range urls {
+		// https://<node-id-address>/ipfs/<YOUR-CID-HERE>?token=<YOUR-TOKEN>&format=car
+		u, err := url.ParseRequestURI(v)
+		if err != nil {
+			log.Printf("url parse error %s", err.Error())
+			continue
+		}
+
+		token := u.Query().Get("token")
+		if token == "" {
+			log.Printf("token is empty")
+			continue
+		}
+
+		nodeURL := fmt.Sprintf("%s://%s/ipfs/%s?token=%s&format=%s", u.Scheme, u.Host, c, url.QueryEscape(token), format)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL, nil)
+		if err != nil {
+			log.Printf("new request error %s", err.Error())
+			continue
+		}
+		req.Header.Set("Accept", accept)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			log.Printf("do request error %s", err.Error())
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("http StatusCode %d", resp.StatusCode)
+			lastErr = fmt.Errorf("http StatusCode %d", resp.StatusCode)
+			continue
+		}
+
+		err = read(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("%s of %s from %s error %s", format, c, u.Host, err.Error())
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("no node to retrieve %s", c)
+}
+
+// carDag is the dag of a verified car, spooled to a temporary file
+type carDag struct {
+	root cid.Cid
+	size int64
+	temp *os.File
+	bs   *blockstore.ReadOnly
+	lsys ipld.LinkSystem
+}
+
+// newCarDag spools the car read from r to a temporary file while its blocks are verified.
+// The car must have root as its only root and hold every block of the dag.
+func newCarDag(r io.Reader, root cid.Cid) (*carDag, error) {
+	temp, err := os.CreateTemp("", "titan-car-*")
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &countingWriter{w: temp}
+	actual, _, err := validateCar(io.TeeReader(r, counter))
+	if err != nil {
+		removeTemp(temp)
+		return nil, fmt.Errorf("verify car: %w", err)
+	}
+
+	if !actual.Equals(root) {
+		removeTemp(temp)
+		return nil, &IntegrityError{Expected: root, Actual: actual}
+	}
+
+	// the index of a CARv2 is not read by validateCar, the blocks are indexed again from the data payload
+	cr, err := car.NewReader(temp)
+	if err != nil {
+		removeTemp(temp)
+		return nil, err
+	}
+
+	dr, err := cr.DataReader()
+	if err != nil {
+		removeTemp(temp)
+		return nil, err
+	}
+
+	bs, err := blockstore.NewReadOnly(dr, nil)
+	if err != nil {
+		removeTemp(temp)
+		return nil, err
+	}
+
+	d := &carDag{root: root, size: counter.n, temp: temp, bs: bs}
+	d.lsys = cidlink.DefaultLinkSystem()
+	// the blocks were verified by validateCar
+	d.lsys.TrustedStorage = true
+	d.lsys.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("not a cidlink")
+		}
+
+		// identity CIDs carry their data, they have no block
+		if cl.Cid.Prefix().MhType == multihash.IDENTITY {
+			dmh, err := multihash.Decode(cl.Cid.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(dmh.Digest), nil
+		}
+
+		blk, err := bs.Get(lc.Ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	return d, nil
+}
+
+// load loads the block c as a dag-pb or raw node
+func (d *carDag) load(ctx context.Context, c cid.Cid) (datamodel.Node, error) {
+	return loadUnixFSNode(ctx, &d.lsys, c)
+}
+
+// file returns the content of the unixfs file node, closing it closes the dag
+func (d *carDag) file(ctx context.Context, node datamodel.Node) (io.ReadCloser, error) {
+	r, err := unixfsFileReader(ctx, &d.lsys, node)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{Reader: r, close: d.Close}, nil
+}
+
+// Close closes and removes the car
+func (d *carDag) Close() error {
+	err := d.bs.Close()
+	if removeErr := removeTemp(d.temp); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// removeTemp closes and removes a temporary file
+func removeTemp(f *os.File) error {
+	err := f.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// loadUnixFSNode loads the block c of a unixfs dag, a dag-pb node or the bytes of a raw leaf
+func loadUnixFSNode(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) (datamodel.Node, error) {
+	var proto datamodel.NodePrototype
+	switch multicodec.Code(c.Prefix().Codec) {
+	case multicodec.DagPb:
+		proto = dagpb.Type.PBNode
+	case multicodec.Raw:
+		proto = basicnode.Prototype.Bytes
+	default:
+		return nil, fmt.Errorf("%s is not a unixfs node, codec %s", c, multicodec.Code(c.Prefix().Codec))
+	}
+
+	return lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, proto)
+}
+
+// unixfsFileReader returns the content of the unixfs file node
+func unixfsFileReader(ctx context.Context, lsys *ipld.LinkSystem, node datamodel.Node) (io.Reader, error) {
+	f, err := file.NewUnixFSFile(ctx, node, lsys)
+	if err != nil {
+		return nil, err
+	}
+	return f.AsLargeBytes()
+}
+
+// walkDirectory calls visit for every entry of the unixfs directory node, basic or sharded.
+// Entry names that could escape the directory or that appear twice are rejected.
+func walkDirectory(ctx context.Context, lsys *ipld.LinkSystem, node datamodel.Node, visit func(name string, c cid.Cid) error) error {
+	dir, err := unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, node, lsys)
+	if err != nil {
+		return err
+	}
+
+	it := dir.MapIterator()
+	if it == nil {
+		return fmt.Errorf("not a unixfs directory")
+	}
+
+	seen := make(map[string]struct{})
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return err
+		}
+
+		name, err := k.AsString()
+		if err != nil {
+			return err
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid directory entry name %q", name)
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("duplicate directory entry name %q", name)
+		}
+		seen[name] = struct{}{}
+
+		l, err := v.AsLink()
+		if err != nil {
+			return err
+		}
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return fmt.Errorf("not a cidlink")
+		}
+
+		if err := visit(name, cl.Cid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// symlinkTarget returns the target of a unixfs symlink node
+func symlinkTarget(node datamodel.Node) (string, bool) {
+	pbNode, ok := node.(dagpb.PBNode)
+	if !ok || !pbNode.FieldData().Exists() {
+		return "", false
+	}
+
+	ufsData, err := data.DecodeUnixFSData(pbNode.FieldData().Must().Bytes())
+	if err != nil || ufsData.FieldDataType().Int() != data.Data_Symlink || !ufsData.FieldData().Exists() {
+		return "", false
+	}
+
+	return string(ufsData.FieldData().Must().Bytes()), true
+}
+
+// writeFileAt writes the content of r to the file destPath
+func writeFileAt(destPath string, r io.Reader) error {
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", destPath, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return nil
+}
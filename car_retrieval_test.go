@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestCarDagReassemblesDirectory(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "folder")
+	large := make([]byte, 3<<20+17)
+	rand.Read(large)
+
+	files := map[string][]byte{
+		"large.bin":        large,
+		"empty":            {},
+		"sub/nested.txt":   []byte("nested"),
+		"sub/deeper/a.txt": []byte("deeper"),
+	}
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	carPath := filepath.Join(t.TempDir(), "folder.car")
+	root, err := createCar(src, carPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dag, err := newCarDag(f, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dag.Close()
+
+	node, err := dag.load(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := writeDirectory(context.Background(), &dag.lsys, node, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%s differs", name)
+		}
+	}
+}
+
+func TestCarDagFile(t *testing.T) {
+	content := make([]byte, 2<<20+3)
+	rand.Read(content)
+
+	src := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	carPath := filepath.Join(t.TempDir(), "file.car")
+	root, err := createCar(src, carPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	car, err := os.ReadFile(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dag, err := newCarDag(bytes.NewReader(car), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := dag.load(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := dag.file(context.Background(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("reassembled file differs")
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dag.temp.Name()); !os.IsNotExist(err) {
+		t.Fatalf("spooled car is not removed: %v", err)
+	}
+
+	// a block that does not hash to its CID
+	tampered := append([]byte(nil), car...)
+	tampered[bytes.Index(tampered, content[1<<20:1<<20+64])] ^= 1
+	if _, err := newCarDag(bytes.NewReader(tampered), root); err == nil {
+		t.Fatal("tampered car was accepted")
+	}
+
+	// a valid car of another asset
+	other, err := cid.Decode("QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var integrityErr *IntegrityError
+	if _, err := newCarDag(bytes.NewReader(car), other); !errors.As(err, &integrityErr) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+}
@@ -270,6 +270,37 @@ var getURLCmd = &cobra.Command{
 	},
 }
 
+var moveFileCmd = &cobra.Command{
+	Use:     "move",
+	Short:   "move file to folder",
+	Example: "move --group-id=1 your-file-cid",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			log.Fatal("Please specify the cid of the file to be move")
+		}
+
+		rootCID := args[0]
+		groupID, _ := cmd.Flags().GetInt("group-id")
+
+		titanURL, apiKey, err := getTitanURLAndAPIKeyFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s, err := storage.Initialize(&storage.Config{TitanURL: titanURL, APIKey: apiKey})
+		if err != nil {
+			log.Fatal("Initialize error ", err)
+		}
+
+		err = s.MoveAsset(cmd.Context(), rootCID, groupID)
+		if err != nil {
+			log.Fatal("MoveAsset ", err)
+		}
+
+		log.Printf("move %s to folder %d success", rootCID, groupID)
+	},
+}
+
 var folderCmd = &cobra.Command{
 	Use:   "folder",
 	Short: "Manage folders",
@@ -384,6 +415,32 @@ var deleteFolderCmd = &cobra.Command{
 	},
 }
 
+var moveFolderCmd = &cobra.Command{
+	Use:   "move",
+	Short: "move --folderID 1 --parentID 0",
+	Run: func(cmd *cobra.Command, args []string) {
+		folderID, _ := cmd.Flags().GetInt("folderID")
+		parentID, _ := cmd.Flags().GetInt("parentID")
+
+		titanURL, apiKey, err := getTitanURLAndAPIKeyFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s, err := storage.Initialize(&storage.Config{TitanURL: titanURL, APIKey: apiKey})
+		if err != nil {
+			log.Fatal("Initialize error ", err)
+		}
+
+		err = s.MoveFolder(cmd.Context(), folderID, parentID)
+		if err != nil {
+			log.Fatal("MoveFolder ", err)
+		}
+
+		log.Printf("move folder %d to %d success", folderID, parentID)
+	},
+}
+
 var docCmd = &cobra.Command{
 	Use:   "gendoc",
 	Short: "Generate markdown documentation",
@@ -413,6 +470,11 @@ func init() {
 	listFolderCmd.Flags().IntP("end", "e", 20, "special the end for list")
 
 	deleteFolderCmd.Flags().Int("groupID", 0, "special the group id")
+
+	moveFileCmd.Flags().Int("group-id", 0, "the target folder id, 0 is the root")
+
+	moveFolderCmd.Flags().Int("folderID", 0, "special the folder id")
+	moveFolderCmd.Flags().Int("parentID", 0, "special the target parent, 0 is the root")
 }
 
 func Execute() {
@@ -422,12 +484,14 @@ func Execute() {
 	rootCmd.AddCommand(getFileCmd)
 	rootCmd.AddCommand(deleteFileCmd)
 	rootCmd.AddCommand(getURLCmd)
+	rootCmd.AddCommand(moveFileCmd)
 	rootCmd.AddCommand(folderCmd)
 	rootCmd.AddCommand(docCmd)
 
 	folderCmd.AddCommand(createFolderCmd)
 	folderCmd.AddCommand(listFolderCmd)
 	folderCmd.AddCommand(deleteFolderCmd)
+	folderCmd.AddCommand(moveFolderCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrAssetExists is matched by the failures of an asset that already exists
+	ErrAssetExists = errors.New("asset already exists")
+	// ErrAssetNotFound is matched by the failures of an asset that does not exist
+	ErrAssetNotFound = errors.New("asset not found")
+	// ErrQuotaExceeded is matched by the failures of a user out of storage or traffic
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrUnauthorized is matched by the failures of a missing, invalid or expired credential
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// errorCodes are the sentinels of the documented err numbers of the results,
+// the failures with another err number match no sentinel
+var errorCodes = map[int]error{
+	isAssetNotExist:        ErrAssetNotFound,
+	isAssetAlreadyExist:    ErrAssetExists,
+	isStorageSizeNotEnough: ErrQuotaExceeded,
+}
+
+// APIError is the failure of a call to the web API, a response with a status other than 200 or a result with a code
+type APIError struct {
+	// HTTPStatus is the status of the response
+	HTTPStatus int
+	// Code is the code of the result, 0 when the status is not 200
+	Code int
+	// Err is the err number of the result, it identifies the failure
+	Err int
+	// Msg is the message of the result, or the body of a response with a status other than 200
+	Msg string
+	// RequestURL is the URL of the request, without its query
+	RequestURL string
+	// Attempts is the number of times the call was sent
+	Attempts int
+
+	// retryAfter is the wait asked by the Retry-After header of the response
+	retryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.HTTPStatus != http.StatusOK {
+		return fmt.Sprintf("%s: status code %d, %s", e.RequestURL, e.HTTPStatus, e.Msg)
+	}
+	return fmt.Sprintf("%s: code: %d, err: %d, msg: %s", e.RequestURL, e.Code, e.Err, e.Msg)
+}
+
+// Is matches the sentinel of the failure, from its err number or from the status or the code 401 of the authentication
+func (e *APIError) Is(target error) bool {
+	return target != nil && e.sentinel() == target
+}
+
+func (e *APIError) sentinel() error {
+	if sentinel, ok := errorCodes[e.Err]; ok {
+		return sentinel
+	}
+
+	if e.HTTPStatus == http.StatusUnauthorized || e.Code == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// ReadResult reads and closes the body of rsp, the response of a call to the web API.
+// It returns the result, or an *APIError if the status is not 200 or the result has a code.
+func ReadResult(rsp *http.Response) (*Result, error) {
+	defer rsp.Body.Close()
+
+	requestURL := ""
+	if rsp.Request != nil {
+		requestURL = redactedURL(rsp.Request)
+	}
+
+	body, err := io.ReadAll(rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return nil, &APIError{
+			HTTPStatus: rsp.StatusCode,
+			Msg:        string(body),
+			RequestURL: requestURL,
+			retryAfter: parseRetryAfter(rsp.Header.Get("Retry-After")),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Result{}
+	if err := json.Unmarshal(body, ret); err != nil {
+		return nil, err
+	}
+
+	if ret.Code != 0 {
+		return nil, &APIError{HTTPStatus: rsp.StatusCode, Code: ret.Code, Err: ret.Err, Msg: ret.Msg, RequestURL: requestURL}
+	}
+
+	return ret, nil
+}
+
+// redactedURL returns the URL of req without its query, which may carry tokens
+func redactedURL(req *http.Request) string {
+	if req.URL == nil {
+		return ""
+	}
+	u := *req.URL
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/storage/get_vip_info":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":401,"message":"token is expired"}`))
+		case "/api/v1/storage/create_asset":
+			w.Write([]byte(`{"code":-1,"err":1017,"msg":"asset already exists"}`))
+		case "/api/v1/storage/share_asset":
+			w.Write([]byte(`{"code":-1,"err":1009,"msg":"asset not exist"}`))
+		case "/api/v1/storage/get_upload_info":
+			w.Write([]byte(`{"code":-1,"err":1024,"msg":"user storage size not enough"}`))
+		case "/api/v1/storage/delete_asset":
+			// the messages are not matched, only the documented err numbers
+			w.Write([]byte(`{"code":-1,"err":1002,"msg":"asset not exist, storage size not enough"}`))
+		default:
+			w.Write([]byte(`{"code":-1,"err":1002,"msg":"internal server error"}`))
+		}
+	}))
+	defer srv.Close()
+
+	ws := NewWebserver(srv.URL, "key", "")
+	ctx := context.Background()
+
+	_, err := ws.GetVipInfo(ctx)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusUnauthorized || !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected an unauthorized api error, got %v", err)
+	}
+	if apiErr.RequestURL != srv.URL+"/api/v1/storage/get_vip_info" {
+		t.Fatalf("unexpected request url %s", apiErr.RequestURL)
+	}
+
+	rsp, err := ws.CreateAsset(ctx, &CreateAssetReq{})
+	if err != nil || !rsp.IsAlreadyExist {
+		t.Fatalf("existing asset returned %v, %v", rsp, err)
+	}
+
+	_, err = ws.ShareAsset(ctx, "", "", "cid", false)
+	if !errors.As(err, &apiErr) || apiErr.Err != 1009 || !errors.Is(err, ErrAssetNotFound) {
+		t.Fatalf("expected an asset not found api error, got %v", err)
+	}
+	// the query carrying the parameters is not reported
+	if strings.Contains(err.Error(), "asset_cid") {
+		t.Fatalf("request query in %q", err.Error())
+	}
+
+	_, err = ws.GetNodeUploadInfo(ctx, "", "", false)
+	if !errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrAssetNotFound) {
+		t.Fatalf("expected an exceeded quota, got %v", err)
+	}
+
+	err = ws.DeleteAsset(ctx, "", "cid")
+	if !errors.As(err, &apiErr) || apiErr.Err != 1002 {
+		t.Fatalf("expected the err number of the result, got %v", err)
+	}
+	for _, sentinel := range []error{ErrAssetExists, ErrAssetNotFound, ErrQuotaExceeded, ErrUnauthorized} {
+		if errors.Is(err, sentinel) {
+			t.Fatalf("%v matches %v", err, sentinel)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Middleware wraps the round-tripper of the requests sent by the SDK, to set headers or to log them for instance.
+// A middleware must not modify the request it is given, it clones it to change its headers.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is a function used as an http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip implements http.RoundTripper
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Chain wraps rt with the middlewares, the first one sees the requests first.
+// A nil rt is http.DefaultTransport.
+func Chain(rt http.RoundTripper, middlewares ...Middleware) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	return rt
+}
+
+// HTTPConfig configures the HTTP client of the SDK
+type HTTPConfig struct {
+	// Client is the base client, for its timeout, its cookies and its transport. nil is http.DefaultClient
+	Client *http.Client
+	// Transport replaces the transport of Client, to set a proxy or custom CAs for instance
+	Transport http.RoundTripper
+	// Middlewares wrap the transport, for every request sent with the client
+	Middlewares []Middleware
+	// Retry is the retry policy of the web API calls, nil is DefaultRetryPolicy
+	Retry *RetryPolicy
+	// TokenSource provides the tokens of the web API calls, it replaces the token given to NewWebserver
+	TokenSource TokenSource
+}
+
+// NewClient returns the client of cfg, Client itself is not modified
+func (cfg HTTPConfig) NewClient() *http.Client {
+	base := cfg.Client
+	if base == nil {
+		base = http.DefaultClient
+	}
+	if cfg.Transport == nil && len(cfg.Middlewares) == 0 {
+		return base
+	}
+
+	c := *base
+	if cfg.Transport != nil {
+		c.Transport = cfg.Transport
+	}
+	c.Transport = Chain(c.Transport, cfg.Middlewares...)
+	return &c
+}
+
+// Option customizes the HTTP client of NewWebserver
+type Option func(*HTTPConfig)
+
+// WithHTTPClient sends the requests with c
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *HTTPConfig) {
+		cfg.Client = c
+	}
+}
+
+// WithRoundTripper sends the requests through rt instead of the transport of the client
+func WithRoundTripper(rt http.RoundTripper) Option {
+	return func(cfg *HTTPConfig) {
+		cfg.Transport = rt
+	}
+}
+
+// WithMiddleware appends middlewares to the chain every request goes through
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(cfg *HTTPConfig) {
+		cfg.Middlewares = append(cfg.Middlewares, middlewares...)
+	}
+}
+
+// NewHTTPConfig applies options on top of the default HTTP configuration
+func NewHTTPConfig(options ...Option) HTTPConfig {
+	cfg := HTTPConfig{}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// SetHeader returns a middleware setting the header key to value on every request, an authorization for instance
+func SetHeader(key, value string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set(key, value)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// UserAgent returns a middleware setting the User-Agent of every request to userAgent
+func UserAgent(userAgent string) Middleware {
+	return SetHeader("User-Agent", userAgent)
+}
+
+// RequestIDHeader is the header set by RequestID
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID returns a middleware setting a random X-Request-ID on the requests that have none
+func RequestID() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get(RequestIDHeader) != "" {
+				return next.RoundTrip(req)
+			}
+
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				return nil, err
+			}
+
+			req = req.Clone(req.Context())
+			req.Header.Set(RequestIDHeader, hex.EncodeToString(id))
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// Logging returns a middleware logging the method, the URL without its query, the status and the duration of every request with logf
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			u := *req.URL
+			// the tokens are often passed in the query
+			u.RawQuery = ""
+
+			rsp, err := next.RoundTrip(req)
+			if err != nil {
+				logf("%s %s failed after %s: %v", req.Method, u.String(), time.Since(start), err)
+				return rsp, err
+			}
+
+			logf("%s %s %d %s", req.Method, u.String(), rsp.StatusCode, time.Since(start))
+			return rsp, nil
+		})
+	}
+}
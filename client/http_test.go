@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMiddlewares(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Write([]byte(`{"code":0,"data":{"uid":"user","vip":true}}`))
+	}))
+	defer srv.Close()
+
+	var (
+		order []string
+		logs  []string
+	)
+	trace := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	base := &http.Client{Timeout: time.Minute}
+	ws := NewWebserver(srv.URL, "key", "", WithHTTPClient(base), WithMiddleware(
+		trace("first"),
+		UserAgent("titan-test/1.0"),
+		RequestID(),
+		SetHeader("X-Tenant", "acme"),
+		Logging(logf),
+		trace("last"),
+	))
+
+	vip, err := ws.GetVipInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vip.UserID != "user" {
+		t.Fatalf("unexpected vip info %+v", vip)
+	}
+
+	if strings.Join(order, ",") != "first,last" {
+		t.Fatalf("middlewares ran in order %v", order)
+	}
+	if headers.Get("User-Agent") != "titan-test/1.0" || headers.Get("X-Tenant") != "acme" || headers.Get("apikey") != "key" {
+		t.Fatalf("unexpected headers %v", headers)
+	}
+	if len(headers.Get(RequestIDHeader)) != 32 {
+		t.Fatalf("unexpected request id %q", headers.Get(RequestIDHeader))
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "GET "+srv.URL+"/api/v1/storage/get_vip_info 200") {
+		t.Fatalf("unexpected logs %v", logs)
+	}
+
+	// the base client is not modified
+	if base.Transport != nil {
+		t.Fatal("the transport of the base client was replaced")
+	}
+	if c := NewHTTPConfig(WithHTTPClient(base)).NewClient(); c != base {
+		t.Fatal("a client without transport nor middlewares is not used as is")
+	}
+}
+
+func TestRoundTripperOption(t *testing.T) {
+	var called bool
+	rt := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":0,"data":{"list":["a","b"]}}`))
+	}))
+	defer srv.Close()
+
+	areas, err := NewWebserver(srv.URL, "key", "", WithRoundTripper(rt)).ListAreaIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !called || len(areas) != 2 {
+		t.Fatalf("round-tripper called %t, areas %v", called, areas)
+	}
+}
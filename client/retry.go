@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retries the calls of the web API that fail with a connection error, a 5xx or a 429.
+// The calls that only read, like ListAssets, ShareAsset or GetVipInfo, are retried on any of these failures.
+// The others, like CreateAsset, are only retried when the connection to the web API could not be opened,
+// since the web API may have processed a request whose response is lost.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is sent, including the first one. 1 or less disables the retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, it doubles with every retry
+	InitialBackoff time.Duration
+	// MaxBackoff bounds the wait between two attempts, including the wait asked by Retry-After
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the web API calls when none is set
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// NoRetry disables the retries
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// WithRetryPolicy sets the retry policy of the web API calls, DefaultRetryPolicy without it
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(cfg *HTTPConfig) {
+		cfg.Retry = &p
+	}
+}
+
+// idempotentCalls are the paths of the calls that can be sent again whatever happened to the previous attempt
+var idempotentCalls = map[string]bool{
+	"/api/v1/storage/get_vip_info":         true,
+	"/api/v1/storage/get_area_id":          true,
+	"/api/v1/storage/share_asset":          true,
+	"/api/v1/storage/get_asset_group_list": true,
+	"/api/v1/storage/get_groups":           true,
+	"/api/v1/storage/get_upload_info":      true,
+	"/api/v1/storage/get_storage_size":     true,
+	"/api/v1/storage/get_asset_count":      true,
+}
+
+// isIdempotent reports whether req can be sent again after any failure
+func isIdempotent(req *http.Request) bool {
+	for path := range idempotentCalls {
+		if strings.HasSuffix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportError is the failure of a call that got no response from the web API
+type TransportError struct {
+	Method     string
+	RequestURL string
+	// Attempts is the number of times the call was sent
+	Attempts int
+	Err      error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s %s failed after %d attempts: %v", e.Method, e.RequestURL, e.Attempts, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Attempts returns the number of times the call that failed with err was sent, 0 if err is not the failure of a call
+func Attempts(err error) int {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Attempts
+	}
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return transportErr.Attempts
+	}
+	return 0
+}
+
+// retryable reports whether the failed attempt of a call can be sent again, and the wait asked by the web API
+func retryable(req *http.Request, err error, idempotent bool) (bool, time.Duration) {
+	if req.Context().Err() != nil {
+		return false, 0
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if !idempotent {
+			return false, 0
+		}
+		switch {
+		case apiErr.HTTPStatus == http.StatusTooManyRequests, apiErr.HTTPStatus >= 500:
+			return true, apiErr.retryAfter
+		}
+		return false, 0
+	}
+
+	if idempotent {
+		return true, 0
+	}
+
+	// the request was not sent if the connection could not be opened
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial", 0
+}
+
+// backoff returns the jittered wait before the retry following attempt
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if p.MaxBackoff > 0 && retryAfter > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+		return retryAfter
+	}
+
+	d := p.InitialBackoff << (attempt - 1)
+	if d <= 0 || (p.MaxBackoff > 0 && d > p.MaxBackoff) {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// half of the wait is random, so the clients retrying together spread out
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter returns the wait of a Retry-After header, in seconds or as a date
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
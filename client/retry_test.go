@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var (
+		requests atomic.Int64
+		failures atomic.Int64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/api/v1/storage/get_vip_info":
+			if failures.Add(1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"code":0,"data":{"uid":"user"}}`))
+		case "/api/v1/storage/get_area_id":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/api/v1/storage/get_groups":
+			w.Write([]byte(`{"code":-1,"err":1002,"msg":"internal server error"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 20 * time.Millisecond}
+	ws := NewWebserver(srv.URL, "key", "", WithRetryPolicy(policy))
+	ctx := context.Background()
+
+	// a read is retried until it succeeds
+	if _, err := ws.GetVipInfo(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Swap(0); n != 3 {
+		t.Fatalf("got %d requests, expected 3", n)
+	}
+
+	// and fails with the number of attempts once they are exhausted
+	_, err := ws.ShareAsset(ctx, "", "", "cid", false)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Attempts != 3 || Attempts(err) != 3 || requests.Swap(0) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", err)
+	}
+
+	// Retry-After is bounded by MaxBackoff
+	start := time.Now()
+	if _, err := ws.ListAreaIDs(ctx); Attempts(err) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retries took %s", elapsed)
+	}
+	requests.Swap(0)
+
+	// a failure reported in the result is not transient
+	if _, err := ws.ListGroups(ctx, 0, 10, 1); Attempts(err) != 1 || requests.Swap(0) != 1 {
+		t.Fatalf("expected a single attempt, got %v", err)
+	}
+
+	// a write may have been processed, it is not sent again
+	if _, err := ws.CreateAsset(ctx, &CreateAssetReq{}); Attempts(err) != 1 || requests.Swap(0) != 1 {
+		t.Fatalf("expected a single attempt, got %v", err)
+	}
+}
+
+func TestRetryConnectionFailures(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	ws := NewWebserver(srv.URL, "key", "", WithRetryPolicy(policy))
+
+	// the connection is refused, so even a write is sent again
+	_, err := ws.CreateAsset(context.Background(), &CreateAssetReq{})
+	var transportErr *TransportError
+	if !errors.As(err, &transportErr) || transportErr.Attempts != 2 {
+		t.Fatalf("expected a transport error after 2 attempts, got %v", err)
+	}
+
+	// the wait between the attempts stops with the context
+	ws = NewWebserver(srv.URL, "key", "", WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = ws.GetVipInfo(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || Attempts(err) != 1 {
+		t.Fatalf("expected the deadline after 1 attempt, got %v", err)
+	}
+
+	if Attempts(errors.New("other")) != 0 {
+		t.Fatal("attempts of an error that is not a call")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 5: time.Second, 80: time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(attempt, 0); d < max/2 || d > max {
+				t.Fatalf("backoff of attempt %d is %s, expected between %s and %s", attempt, d, max/2, max)
+			}
+		}
+	}
+
+	if d := p.backoff(1, 3*time.Second); d != time.Second {
+		t.Fatalf("Retry-After not bounded, got %s", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d <= 58*time.Second || d > time.Minute {
+		t.Fatalf("unexpected wait of a Retry-After date %s", d)
+	}
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenRefreshWindow is how long before its expiry a token is refreshed
+const tokenRefreshWindow = time.Minute
+
+// Token is a token of the web API and its expiry
+type Token struct {
+	Value string
+	// Expiry is the time the token expires, the zero time never expires
+	Expiry time.Time
+}
+
+// expiresWithin reports whether the token expires in less than d
+func (t Token) expiresWithin(d time.Duration) bool {
+	return !t.Expiry.IsZero() && time.Until(t.Expiry) < d
+}
+
+// TokenSource provides the token sent with the web API calls, it is safe for concurrent use
+type TokenSource interface {
+	// Token returns a token that does not expire soon, it is refreshed if needed
+	Token(ctx context.Context) (string, error)
+	// Invalidate discards token after the web API rejected it, the next call to Token refreshes it
+	Invalidate(token string)
+}
+
+// RefreshFunc returns a new token, current is the token being replaced, it is empty before the first one
+type RefreshFunc func(ctx context.Context, current Token) (Token, error)
+
+// NewTokenSource returns a TokenSource starting with initial, refreshed with refresh a minute before it expires.
+// An empty initial token is fetched with refresh on first use.
+// The concurrent calls to Token wait for a single refresh.
+func NewTokenSource(initial Token, refresh RefreshFunc) TokenSource {
+	return &refreshingTokenSource{token: initial, refresh: refresh}
+}
+
+// WithTokenSource authenticates the web API calls with the tokens of ts, a call rejected with a 401 is sent again once with a new token
+func WithTokenSource(ts TokenSource) Option {
+	return func(cfg *HTTPConfig) {
+		cfg.TokenSource = ts
+	}
+}
+
+type refreshingTokenSource struct {
+	refresh RefreshFunc
+
+	mu    sync.Mutex
+	token Token
+	// invalid is set when the web API rejected token
+	invalid bool
+	// refreshing is closed when the refresh in progress is done, nil without one
+	refreshing chan struct{}
+}
+
+func (s *refreshingTokenSource) Token(ctx context.Context) (string, error) {
+	for {
+		s.mu.Lock()
+		current, invalid := s.token, s.invalid
+		if current.Value != "" && !invalid && !current.expiresWithin(tokenRefreshWindow) {
+			s.mu.Unlock()
+			return current.Value, nil
+		}
+
+		if wait := s.refreshing; wait != nil {
+			s.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		done := make(chan struct{})
+		s.refreshing = done
+		s.mu.Unlock()
+
+		token, err := s.refresh(ctx, current)
+		if err == nil && token.Value == "" {
+			err = fmt.Errorf("empty token")
+		}
+
+		s.mu.Lock()
+		if err == nil {
+			s.token, s.invalid = token, false
+		}
+		s.refreshing = nil
+		close(done)
+		s.mu.Unlock()
+
+		if err != nil {
+			// a token refreshed before its expiry can still be used
+			if current.Value != "" && !invalid && !current.expiresWithin(0) {
+				return current.Value, nil
+			}
+			return "", fmt.Errorf("refresh token: %w", err)
+		}
+		return token.Value, nil
+	}
+}
+
+func (s *refreshingTokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the token may have been refreshed by another call already
+	if s.token.Value == token {
+		s.invalid = true
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+	var refreshes atomic.Int64
+	refresh := func(ctx context.Context, current Token) (Token, error) {
+		refreshes.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return Token{Value: "new", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+	ctx := context.Background()
+
+	// a token far from its expiry is kept
+	ts := NewTokenSource(Token{Value: "old", Expiry: time.Now().Add(time.Hour)}, refresh)
+	if token, err := ts.Token(ctx); err != nil || token != "old" || refreshes.Load() != 0 {
+		t.Fatalf("got %s, %v", token, err)
+	}
+
+	// the concurrent calls wait for a single refresh of a token about to expire
+	ts = NewTokenSource(Token{Value: "old", Expiry: time.Now().Add(10 * time.Second)}, refresh)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := ts.Token(ctx); err != nil || token != "new" {
+				t.Errorf("got %s, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := refreshes.Swap(0); n != 1 {
+		t.Fatalf("got %d refreshes, expected 1", n)
+	}
+
+	// invalidating a token that was already replaced does nothing
+	ts.Invalidate("old")
+	if token, _ := ts.Token(ctx); token != "new" || refreshes.Load() != 0 {
+		t.Fatal("a refreshed token was invalidated")
+	}
+
+	failing := func(ctx context.Context, current Token) (Token, error) {
+		return Token{}, errors.New("refresh failed")
+	}
+
+	// a failed early refresh keeps the token until it expires
+	ts = NewTokenSource(Token{Value: "old", Expiry: time.Now().Add(10 * time.Second)}, failing)
+	if token, err := ts.Token(ctx); err != nil || token != "old" {
+		t.Fatalf("got %s, %v", token, err)
+	}
+	ts = NewTokenSource(Token{Value: "old", Expiry: time.Now().Add(-time.Second)}, failing)
+	if _, err := ts.Token(ctx); err == nil {
+		t.Fatal("an expired token was returned")
+	}
+}
+
+func TestTokenSourceUnauthorized(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("jwtauthorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// the body of the call is sent again with the new token
+		if r.Method == http.MethodPost {
+			if body, _ := io.ReadAll(r.Body); len(body) == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		w.Write([]byte(`{"code":0,"data":{}}`))
+	}))
+	defer srv.Close()
+
+	var refreshes atomic.Int64
+	ts := NewTokenSource(Token{Value: "revoked", Expiry: time.Now().Add(time.Hour)}, func(ctx context.Context, current Token) (Token, error) {
+		refreshes.Add(1)
+		return Token{Value: "new"}, nil
+	})
+	ws := NewWebserver(srv.URL, "", "", WithTokenSource(ts), WithRetryPolicy(NoRetry))
+
+	if err := ws.RenameAsset(context.Background(), "cid", "name"); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 || refreshes.Load() != 1 {
+		t.Fatalf("got %d requests and %d refreshes, expected 2 and 1", requests.Load(), refreshes.Load())
+	}
+
+	// a token rejected again is not refreshed in a loop
+	ts = NewTokenSource(Token{Value: "revoked"}, func(ctx context.Context, current Token) (Token, error) {
+		return Token{Value: "revoked too"}, nil
+	})
+	ws = NewWebserver(srv.URL, "", "", WithTokenSource(ts), WithRetryPolicy(NoRetry))
+	requests.Store(0)
+
+	if _, err := ws.GetVipInfo(context.Background()); !errors.Is(err, ErrUnauthorized) || requests.Load() != 2 {
+		t.Fatalf("expected unauthorized after 2 requests, got %v after %d", err, requests.Load())
+	}
+}
@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 
 	"github.com/ipfs/go-cid"
 )
 
-const isAssetAlreadyExist = 1017
+// err numbers of the scheduler results
+const (
+	isAssetNotExist        = 1009
+	isAssetAlreadyExist    = 1017
+	isStorageSizeNotEnough = 1024
+)
 
 const (
 	AssetTransferTypeUpload   = "upload"
@@ -73,18 +79,47 @@ type Webserver interface {
 
 var _ Webserver = (*webserver)(nil)
 
+// UploadInfoOptions are the parameters of GetNodeUploadInfoWithOptions
+type UploadInfoOptions struct {
+	Area    string
+	URLMode bool
+	// Encrypted asks for the nodes of an asset encrypted by the client
+	Encrypted bool
+}
+
+// UploadInfoGetter is implemented by the Webservers that take the options of an upload, like its encryption.
+// It is kept out of Webserver so the existing implementations of Webserver still satisfy it.
+type UploadInfoGetter interface {
+	GetNodeUploadInfoWithOptions(ctx context.Context, userID string, opts UploadInfoOptions) (*UploadInfo, error)
+}
+
+var _ UploadInfoGetter = (*webserver)(nil)
+
 // NewWebserver creates a new Scheduler instance with the specified URL, headers, and options.
-func NewWebserver(url string, apiKey, token string) Webserver {
-	return &webserver{url: url, apiKey: apiKey, token: token, client: http.DefaultClient}
+// The requests are sent with http.DefaultClient unless options set another client, transport or middlewares.
+// The failed calls are retried with DefaultRetryPolicy unless WithRetryPolicy sets another one.
+// WithTokenSource replaces token with the refreshed tokens of a TokenSource.
+func NewWebserver(url string, apiKey, token string, options ...Option) Webserver {
+	cfg := NewHTTPConfig(options...)
+
+	retry := DefaultRetryPolicy
+	if cfg.Retry != nil {
+		retry = *cfg.Retry
+	}
+
+	return &webserver{url: url, apiKey: apiKey, token: token, tokens: cfg.TokenSource, client: cfg.NewClient(), retry: retry}
 }
 
 type webserver struct {
 	// client *Client
 	url    string
 	client *http.Client
+	retry  RetryPolicy
 
 	apiKey string
 	token  string
+	// tokens replaces token when it is set
+	tokens TokenSource
 }
 
 func (s *webserver) GetVipInfo(ctx context.Context) (*VipInfo, error) {
@@ -96,31 +131,11 @@ func (s *webserver) GetVipInfo(ctx context.Context) (*VipInfo, error) {
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	vipInfo := &VipInfo{}
 	err = interfaceToStruct(ret.Data, vipInfo)
 	if err != nil {
@@ -149,31 +164,11 @@ func (s *webserver) ListAreaIDs(ctx context.Context) ([]string, error) {
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	var listAreas = &ListAreaID{}
 	err = interfaceToStruct(ret.Data, listAreas)
 	if err != nil {
@@ -210,6 +205,7 @@ func (s *webserver) CreateAsset(ctx context.Context, caReq *CreateAssetReq) (*Cr
 		AssetType: caReq.AssetType,
 		AssetSize: caReq.AssetSize,
 		GroupID:   int64(caReq.GroupID),
+		Encrypted: caReq.Encrypted,
 	}
 
 	jsonBytes, err := json.Marshal(postData)
@@ -226,34 +222,14 @@ func (s *webserver) CreateAsset(ctx context.Context, caReq *CreateAssetReq) (*Cr
 	req.Header.Set("Content-Type", "application/json")
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
+	ret, err := s.do(req)
+	if errors.Is(err, ErrAssetExists) {
+		return &CreateAssetRsp{IsAlreadyExist: true, Endpoints: nil}, nil
 	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		if ret.Err == isAssetAlreadyExist {
-			return &CreateAssetRsp{IsAlreadyExist: true, Endpoints: nil}, nil
-		}
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	endpoints := make([]*Endpoint, 0)
 	err = interfaceToStruct(ret.Data, &endpoints)
 	if err != nil {
@@ -274,31 +250,10 @@ func (s *webserver) DeleteAsset(ctx context.Context, userID, assetCID string) er
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
+	if _, err := s.do(req); err != nil {
 		return err
 	}
 
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	return nil
 }
 
@@ -318,38 +273,11 @@ func (s *webserver) ShareAsset(ctx context.Context, userID, areaID, assetCID str
 
 	// log.Printf("url:%v apikey:%v token:%v", url, s.apiKey, s.token)
 
-	rsp, err := s.client.Do(req)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	rsp.Body = io.NopCloser(bytes.NewBuffer(body))
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return nil, err
-	}
-
-	// requestRaw, _ := httputil.DumpRequest(req, true)
-	// responseRaw, _ := httputil.DumpResponse(rsp, true)
-
-	// log.Printf("ShareAsset DUMP:\n request: %s\nresponse: %s\n", string(requestRaw), string(responseRaw))
-
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	result := &ShareAssetResult{}
 	err = interfaceToStruct(ret.Data, result)
 	if err != nil {
@@ -374,37 +302,17 @@ func (s *webserver) ListAssets(ctx context.Context, parent, pageSize, page int,
 		url += fmt.Sprintf("&groupid=%d", folderID)
 	}
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-	}
-
-	s.setCredential(req)
-
-	rsp, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
+	s.setCredential(req)
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	type Object struct {
 		AssetOverview *AssetOverview `json:"AssetOverview"`
 	}
@@ -452,42 +360,21 @@ func (s *webserver) RenameAsset(ctx context.Context, assetCID string, newName st
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBytes))
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-	}
-
-	s.setCredential(req)
-
-	rsp, err := s.client.Do(req)
 	if err != nil {
 		return err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
+	s.setCredential(req)
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
+	if _, err := s.do(req); err != nil {
 		return err
 	}
-
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
 	return nil
 }
 
 // CreateGroup create a group
 func (s *webserver) CreateGroup(ctx context.Context, name string, parent int) (*AssetGroup, error) {
-	url := fmt.Sprintf("%s/api/v1/storage/create_group?&name=%s&parent=%d", s.url, name, parent)
+	url := fmt.Sprintf("%s/api/v1/storage/create_group?&name=%s&parent=%d", s.url, neturl.QueryEscape(name), parent)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -495,31 +382,11 @@ func (s *webserver) CreateGroup(ctx context.Context, name string, parent int) (*
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return nil, err
-	}
-
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	data := struct {
 		Group *AssetGroup `json:"group"`
 	}{}
@@ -535,36 +402,17 @@ func (s *webserver) CreateGroup(ctx context.Context, name string, parent int) (*
 func (s *webserver) ListGroups(ctx context.Context, parent, pageSize, page int) (*ListAssetGroupRsp, error) {
 	url := fmt.Sprintf("%s/api/v1/storage/get_groups?parent=%d&page_size=%d&page=%d", s.url, parent, pageSize, page)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-	}
-
-	s.setCredential(req)
-
-	rsp, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code %d", rsp.StatusCode)
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
+	s.setCredential(req)
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	listAssetGroupRsp := &ListAssetGroupRsp{}
 	err = interfaceToStruct(ret.Data, listAssetGroupRsp)
 	if err != nil {
@@ -583,36 +431,15 @@ func (s *webserver) ListAssetSummary(ctx context.Context, userID string, parent,
 func (s *webserver) DeleteGroup(ctx context.Context, userID string, gid int) error {
 	url := fmt.Sprintf("%s/api/v1/storage/delete_group?user_id=%s&group_id=%d", s.url, userID, gid)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
-	}
-
-	s.setCredential(req)
-
-	rsp, err := s.client.Do(req)
 	if err != nil {
 		return err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
+	s.setCredential(req)
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
+	if _, err := s.do(req); err != nil {
 		return err
 	}
-
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
 	return nil
 }
 
@@ -623,12 +450,34 @@ func (s *webserver) RenameGroup(ctx context.Context, userID, newName string, gro
 
 // MoveAssetToGroup move a asset to group
 func (s *webserver) MoveAssetToGroup(ctx context.Context, userID, cid string, groupID int) error {
-	return fmt.Errorf("not implemnet")
+	url := fmt.Sprintf("%s/api/v1/storage/move_asset_to_group?user_id=%s&asset_cid=%s&group_id=%d", s.url, neturl.QueryEscape(userID), neturl.QueryEscape(cid), groupID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	s.setCredential(req)
+
+	if _, err := s.do(req); err != nil {
+		return err
+	}
+	return nil
 }
 
 // MoveAssetGroup move a asset group
 func (s *webserver) MoveAssetGroup(ctx context.Context, userID string, groupID, targetGroupID int) error {
-	return fmt.Errorf("not implemnet")
+	url := fmt.Sprintf("%s/api/v1/storage/move_group_to_group?user_id=%s&group_id=%d&target_group_id=%d", s.url, neturl.QueryEscape(userID), groupID, targetGroupID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	s.setCredential(req)
+
+	if _, err := s.do(req); err != nil {
+		return err
+	}
+	return nil
 }
 
 // GetAPPKeyPermissions get the permissions of user app key
@@ -638,12 +487,17 @@ func (s *webserver) GetAPPKeyPermissions(ctx context.Context, userID, keyName st
 
 // GetNodeUploadInfo
 func (s *webserver) GetNodeUploadInfo(ctx context.Context, userID, area string, urlMode bool) (*UploadInfo, error) {
-	url := fmt.Sprintf("%s/api/v1/storage/get_upload_info?encrypted=false&need_trace=true", s.url)
-	if urlMode {
+	return s.GetNodeUploadInfoWithOptions(ctx, userID, UploadInfoOptions{Area: area, URLMode: urlMode})
+}
+
+// GetNodeUploadInfoWithOptions returns the nodes of an upload with the options of the upload
+func (s *webserver) GetNodeUploadInfoWithOptions(ctx context.Context, userID string, opts UploadInfoOptions) (*UploadInfo, error) {
+	url := fmt.Sprintf("%s/api/v1/storage/get_upload_info?encrypted=%t&need_trace=true", s.url, opts.Encrypted)
+	if opts.URLMode {
 		url += "&urlMode=true"
 	}
-	if area != "" {
-		url += fmt.Sprintf("&area_id=%s", area)
+	if opts.Area != "" {
+		url += fmt.Sprintf("&area_id=%s", opts.Area)
 	}
 
 	// fmt.Println("GetUploadInfo url: ", url)
@@ -655,31 +509,11 @@ func (s *webserver) GetNodeUploadInfo(ctx context.Context, userID, area string,
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	uploadNodes := &UploadInfo{}
 	err = interfaceToStruct(ret.Data, uploadNodes)
 	if err != nil {
@@ -729,31 +563,10 @@ func (s *webserver) AssetTransferReport(ctx context.Context, req AssetTransferRe
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("apikey", s.apiKey)
 
-	rsp, err := s.client.Do(request)
-	if err != nil {
+	if _, err := s.do(request); err != nil {
 		return err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
-
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return err
-	}
-
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	return nil
 }
 
@@ -768,31 +581,11 @@ func (s *webserver) GetUserStorage(ctx context.Context) (*UserStorageInfo, error
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return nil, err
-	}
-
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	storageInfo := &UserStorageInfo{}
 	err = interfaceToStruct(ret.Data, storageInfo)
 	if err != nil {
@@ -813,38 +606,122 @@ func (s *webserver) GetAssetCount(ctx context.Context) (*AssetCountInfo, error)
 
 	s.setCredential(req)
 
-	rsp, err := s.client.Do(req)
+	ret, err := s.do(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d %s", rsp.StatusCode, string(buf))
+	assetCount := &AssetCountInfo{}
+	err = interfaceToStruct(ret.Data, assetCount)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := io.ReadAll(rsp.Body)
+	return assetCount, nil
+}
+
+// do sends req and returns its result, an *APIError or a *TransportError if the call failed.
+// The call is sent again as long as the retry policy allows it.
+func (s *webserver) do(req *http.Request) (*Result, error) {
+	idempotent := isIdempotent(req)
+
+	for attempt := 1; ; attempt++ {
+		ret, err := s.send(req)
+		if err == nil {
+			return ret, nil
+		}
+
+		retry, retryAfter := retryable(req, err, idempotent)
+		if !retry || attempt >= s.retry.MaxAttempts {
+			return nil, withAttempts(req, err, attempt)
+		}
+
+		next, rewindErr := rewind(req)
+		if rewindErr != nil {
+			return nil, withAttempts(req, err, attempt)
+		}
+		req = next
+
+		delay := s.retry.backoff(attempt, retryAfter)
+		log.Printf("%s %s failed, retry in %s: %v", req.Method, redactedURL(req), delay, err)
+		if sleepErr := sleep(req.Context(), delay); sleepErr != nil {
+			return nil, withAttempts(req, sleepErr, attempt)
+		}
+	}
+}
+
+// send sends a single attempt of req.
+// With a token source, the attempt is sent again once with a new token if the web API rejects the token.
+func (s *webserver) send(req *http.Request) (*Result, error) {
+	if s.tokens == nil {
+		return s.roundTrip(req)
+	}
+
+	token, err := s.tokens.Token(req.Context())
 	if err != nil {
 		return nil, err
 	}
 
-	ret := &Result{}
-	err = json.Unmarshal(body, ret)
+	ret, err := s.roundTrip(withToken(req, token))
+	if !errors.Is(err, ErrUnauthorized) {
+		return ret, err
+	}
+
+	// the token was revoked or expired before its expiry
+	s.tokens.Invalidate(token)
+
+	next, rewindErr := rewind(req)
+	if rewindErr != nil {
+		return nil, err
+	}
+	token, tokenErr := s.tokens.Token(req.Context())
+	if tokenErr != nil {
+		return nil, err
+	}
+	return s.roundTrip(withToken(next, token))
+}
+
+func (s *webserver) roundTrip(req *http.Request) (*Result, error) {
+	rsp, err := s.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	return ReadResult(rsp)
+}
 
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
+// rewind returns req with a new body to send it again, the body of the previous attempt was consumed
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("body of %s %s can not be sent again", req.Method, redactedURL(req))
 	}
 
-	assetCount := &AssetCountInfo{}
-	err = interfaceToStruct(ret.Data, assetCount)
+	body, err := req.GetBody()
 	if err != nil {
 		return nil, err
 	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
 
-	return assetCount, nil
+// withToken returns a copy of req authenticated with token
+func withToken(req *http.Request, token string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("jwtauthorization", fmt.Sprintf("Bearer %s", token))
+	return req
+}
+
+// withAttempts records the number of attempts of the call that failed with err
+func withAttempts(req *http.Request, err error, attempts int) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		apiErr.Attempts = attempts
+		return err
+	}
+	return &TransportError{Method: req.Method, RequestURL: redactedURL(req), Attempts: attempts, Err: err}
 }
 
 func (s *webserver) setCredential(r *http.Request) {
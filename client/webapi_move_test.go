@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+func TestMoveRequests(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		query  neturl.Values
+	}
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, request{method: r.Method, path: r.URL.Path, query: r.URL.Query()})
+		w.Write([]byte(`{"code":0}`))
+	}))
+	defer srv.Close()
+
+	ws := NewWebserver(srv.URL, "key", "")
+	ctx := context.Background()
+
+	if err := ws.MoveAssetToGroup(ctx, "user", "bafy", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.MoveAssetGroup(ctx, "user", 2, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// the moves follow create_group and delete_group, a GET with the parameters in the query
+	expect := []request{
+		{method: "GET", path: "/api/v1/storage/move_asset_to_group", query: neturl.Values{"user_id": {"user"}, "asset_cid": {"bafy"}, "group_id": {"3"}}},
+		{method: "GET", path: "/api/v1/storage/move_group_to_group", query: neturl.Values{"user_id": {"user"}, "group_id": {"2"}, "target_group_id": {"5"}}},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("got %d requests, expected %d", len(got), len(expect))
+	}
+	for i, req := range expect {
+		if got[i].method != req.method || got[i].path != req.path || got[i].query.Encode() != req.query.Encode() {
+			t.Fatalf("got %s %s?%s, expected %s %s?%s", got[i].method, got[i].path, got[i].query.Encode(), req.method, req.path, req.query.Encode())
+		}
+	}
+}
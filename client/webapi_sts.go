@@ -24,6 +24,11 @@ type AssetProperty struct {
 	AssetType string
 	NodeID    string
 	GroupID   int
+	// Encrypted is true if the content is encrypted on the client side
+	Encrypted bool
+	// Settings holds the upload settings recorded by the request options of the storage,
+	// it is never sent to the scheduler
+	Settings any `json:"-"`
 }
 
 type CreateAssetReq struct {
@@ -164,7 +169,9 @@ type ShareAssetResult struct {
 	Size     int64    `json:"size"`
 	URLs     []string `json:"url"`
 	TraceID  string   `json:"trace_id"`
-	FileName string
+	// Encrypted is true if the asset was encrypted on the client side when it was uploaded
+	Encrypted bool `json:"encrypted"`
+	FileName  string
 
 	// map[url]struct{WorkloadID,NodeID,Token}
 	// Extra map[string]WorkloadInfo
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/trickle"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+)
+
+// DagLayout is the shape of the tree a file is split into
+type DagLayout string
+
+const (
+	// DagBalanced fills every level of the tree before adding a new one, this is the default
+	DagBalanced DagLayout = "balanced"
+	// DagTrickle builds a tree suited to content read sequentially, like videos
+	DagTrickle DagLayout = "trickle"
+)
+
+// DagOptions describes how content is built into a unixfs dag, and so its root CID.
+// The zero value builds the dag like `ipfs add` with its default flags:
+// 256KiB chunks, CIDv0, unixfs leaves, sha2-256 and a balanced layout.
+type DagOptions struct {
+	// ChunkSize is the size of the leaves, 256KiB if 0 and at most 1MiB
+	ChunkSize int64
+	// RawLeaves stores the leaves as raw blocks instead of unixfs nodes, it requires CIDv1
+	RawLeaves bool
+	// CidVersion is 0 or 1, CIDv0 only supports sha2-256
+	CidVersion int
+	// HashFunction is multihash.SHA2_256 or multihash.BLAKE3, sha2-256 if 0
+	HashFunction uint64
+	// Layout is DagBalanced if empty
+	Layout DagLayout
+}
+
+// DefaultDagOptions builds the same dag as an upload without WithDagOptions
+var DefaultDagOptions = DagOptions{RawLeaves: true, CidVersion: 1}
+
+// WithDagOptions builds the dag of the upload with dag instead of the default of the nodes.
+// The car is then always made locally, so the returned CID is the one computed by CalculateCid with the same options.
+func WithDagOptions(dag DagOptions) RequestOption {
+	return requestSetting(func(o *requestSettings) {
+		o.dag = &dag
+	})
+}
+
+// validate reports options that can not build a dag
+func (o *DagOptions) validate() error {
+	if o.ChunkSize < 0 || o.ChunkSize > int64(chunker.ChunkSizeLimit) {
+		return fmt.Errorf("chunk size %d is out of range, max %d", o.ChunkSize, chunker.ChunkSizeLimit)
+	}
+
+	switch o.HashFunction {
+	case 0, multihash.SHA2_256, multihash.BLAKE3:
+	default:
+		return fmt.Errorf("unsupported hash function %s", multihash.Codes[o.HashFunction])
+	}
+
+	switch o.CidVersion {
+	case 0:
+		if o.RawLeaves {
+			return fmt.Errorf("raw leaves require CIDv1")
+		}
+		if o.hashFunction() != multihash.SHA2_256 {
+			return fmt.Errorf("CIDv0 only supports sha2-256")
+		}
+	case 1:
+	default:
+		return fmt.Errorf("unsupported CID version %d", o.CidVersion)
+	}
+
+	switch o.Layout {
+	case "", DagBalanced, DagTrickle:
+	default:
+		return fmt.Errorf("unsupported dag layout %s", o.Layout)
+	}
+
+	return nil
+}
+
+func (o *DagOptions) hashFunction() uint64 {
+	if o.HashFunction == 0 {
+		return multihash.SHA2_256
+	}
+	return o.HashFunction
+}
+
+func (o *DagOptions) chunkSize() int64 {
+	if o.ChunkSize == 0 {
+		return chunker.DefaultBlockSize
+	}
+	return o.ChunkSize
+}
+
+// prefix is the CID prefix of the dag-pb nodes, raw leaves use it with the raw codec
+func (o *DagOptions) prefix() cid.Prefix {
+	return cid.Prefix{
+		Version:  uint64(o.CidVersion),
+		Codec:    cid.DagProtobuf,
+		MhType:   o.hashFunction(),
+		MhLength: -1,
+	}
+}
+
+// buildFile builds the dag of r and passes every block to put, returns the root CID
+func (o *DagOptions) buildFile(r io.Reader, put func(c cid.Cid, data []byte) error) (cid.Cid, error) {
+	if err := o.validate(); err != nil {
+		return cid.Cid{}, err
+	}
+
+	node, err := o.fileNode(putDAGService(put), r)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	return node.Cid(), nil
+}
+
+// buildPaths builds the dag of paths and passes every block to put, returns the root CID.
+// Unless noWrap is set, the paths are wrapped in a directory under the name at the same index.
+func (o *DagOptions) buildPaths(ctx context.Context, noWrap bool, names, paths []string, put func(c cid.Cid, data []byte) error) (cid.Cid, error) {
+	if err := o.validate(); err != nil {
+		return cid.Cid{}, err
+	}
+
+	ds := putDAGService(put)
+
+	nodes := make([]format.Node, 0, len(paths))
+	for _, p := range paths {
+		node, err := o.pathNode(ctx, ds, p)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if noWrap {
+			return node.Cid(), nil
+		}
+		nodes = append(nodes, node)
+	}
+
+	root, err := o.directoryNode(ctx, ds, names, nodes)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root.Cid(), nil
+}
+
+// fileNode builds the dag of r, the leaves and intermediate nodes are added to ds
+func (o *DagOptions) fileNode(ds format.DAGService, r io.Reader) (format.Node, error) {
+	params := helpers.DagBuilderParams{
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		RawLeaves:  o.RawLeaves,
+		CidBuilder: o.prefix(),
+		Dagserv:    ds,
+	}
+
+	db, err := params.New(chunker.NewSizeSplitter(r, o.chunkSize()))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Layout == DagTrickle {
+		return trickle.Layout(db)
+	}
+	return balanced.Layout(db)
+}
+
+// pathNode builds the dag of the file, directory or symlink p
+func (o *DagOptions) pathNode(ctx context.Context, ds format.DAGService, p string) (format.Node, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ft.SymlinkData(target)
+		if err != nil {
+			return nil, err
+		}
+		return o.addProtoNode(ctx, ds, merkledag.NodeWithData(data))
+
+	case info.IsDir():
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(entries))
+		nodes := make([]format.Node, 0, len(entries))
+		for _, entry := range entries {
+			node, err := o.pathNode(ctx, ds, filepath.Join(p, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, entry.Name())
+			nodes = append(nodes, node)
+		}
+		return o.directoryNode(ctx, ds, names, nodes)
+
+	default:
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return o.fileNode(ds, f)
+	}
+}
+
+// directoryNode builds a directory of nodes under the name at the same index, large directories are sharded
+func (o *DagOptions) directoryNode(ctx context.Context, ds format.DAGService, names []string, nodes []format.Node) (format.Node, error) {
+	dir := uio.NewDirectory(ds)
+	dir.SetCidBuilder(o.prefix())
+
+	for i, node := range nodes {
+		if err := dir.AddChild(ctx, names[i], node); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	// the shards below the root are added by GetNode, the root is not
+	if err := ds.Add(ctx, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (o *DagOptions) addProtoNode(ctx context.Context, ds format.DAGService, node *merkledag.ProtoNode) (format.Node, error) {
+	if err := node.SetCidBuilder(o.prefix()); err != nil {
+		return nil, err
+	}
+	if err := ds.Add(ctx, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// putDAGService is a write only format.DAGService passing every added node to the function
+type putDAGService func(c cid.Cid, data []byte) error
+
+func (put putDAGService) Get(_ context.Context, c cid.Cid) (format.Node, error) {
+	return nil, format.ErrNotFound{Cid: c}
+}
+
+func (put putDAGService) GetMany(_ context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	ch := make(chan *format.NodeOption, len(cids))
+	for _, c := range cids {
+		ch <- &format.NodeOption{Err: format.ErrNotFound{Cid: c}}
+	}
+	close(ch)
+	return ch
+}
+
+func (put putDAGService) Add(_ context.Context, node format.Node) error {
+	return put(node.Cid(), node.RawData())
+}
+
+func (put putDAGService) AddMany(ctx context.Context, nodes []format.Node) error {
+	for _, node := range nodes {
+		if err := put.Add(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (put putDAGService) Remove(context.Context, cid.Cid) error {
+	return nil
+}
+
+func (put putDAGService) RemoveMany(context.Context, []cid.Cid) error {
+	return nil
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/multiformats/go-multihash"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+func TestDefaultDagOptionsMatchDefaultBuilder(t *testing.T) {
+	for _, size := range []int{0, 1, 256 << 10, 256<<10 + 1, 3 << 20} {
+		content := make([]byte, size)
+		rand.Read(content)
+
+		expect, err := CalculateCid(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := CalculateCid(bytes.NewReader(content), WithDagOptions(DefaultDagOptions))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !got.Equals(expect) {
+			t.Fatalf("size %d: got %s, expected %s", size, got, expect)
+		}
+	}
+}
+
+func TestCalculateCidLikeIpfsAdd(t *testing.T) {
+	content := []byte("hello world\n")
+
+	// the CID of `echo "hello world" | ipfs add`
+	got, err := CalculateCid(bytes.NewReader(content), WithDagOptions(DagOptions{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o" {
+		t.Fatalf("got %s, expected QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o", got)
+	}
+
+	// a single chunk with raw leaves is a raw block
+	for _, hash := range []uint64{multihash.SHA2_256, multihash.BLAKE3} {
+		expect, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: hash, MhLength: -1}.Sum(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := CalculateCid(bytes.NewReader(content), WithDagOptions(DagOptions{CidVersion: 1, RawLeaves: true, HashFunction: hash}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equals(expect) {
+			t.Fatalf("got %s, expected %s", got, expect)
+		}
+	}
+}
+
+func TestDagOptionsValidate(t *testing.T) {
+	for _, dag := range []DagOptions{
+		{RawLeaves: true},
+		{HashFunction: multihash.BLAKE3},
+		{CidVersion: 2},
+		{CidVersion: 1, HashFunction: multihash.MD5},
+		{CidVersion: 1, ChunkSize: 2 << 20},
+		{CidVersion: 1, Layout: "flat"},
+	} {
+		if _, err := CalculateCid(bytes.NewReader([]byte("titan")), WithDagOptions(dag)); err == nil {
+			t.Fatalf("%+v is accepted", dag)
+		}
+	}
+}
+
+// TestUploadWithDagOptions checks that every upload path sends a car whose root is the CID computed locally
+func TestUploadWithDagOptions(t *testing.T) {
+	content := make([]byte, 600<<10)
+	rand.Read(content)
+
+	filePath := filepath.Join(t.TempDir(), "titan.bin")
+	if err := os.WriteFile(filePath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dags := []DagOptions{
+		{},
+		{CidVersion: 1, RawLeaves: true, ChunkSize: 64 << 10},
+		{CidVersion: 1, HashFunction: multihash.BLAKE3, Layout: DagTrickle, ChunkSize: 16 << 10},
+		{CidVersion: 1, RawLeaves: true, HashFunction: multihash.BLAKE3},
+	}
+
+	uploads := map[string]func(s *storage, dag DagOptions) (cid.Cid, error){
+		"UploadAsset file": func(s *storage, dag DagOptions) (cid.Cid, error) {
+			return s.UploadAsset(context.Background(), filePath, nil, nil, WithDagOptions(dag))
+		},
+		"UploadAsset reader": func(s *storage, dag DagOptions) (cid.Cid, error) {
+			return s.UploadAsset(context.Background(), "", bytes.NewReader(content), nil, WithDagOptions(dag))
+		},
+		"UploadStream encrypted": func(s *storage, dag DagOptions) (cid.Cid, error) {
+			return s.UploadStream(context.Background(), bytes.NewReader(content), "titan.bin", nil, WithDagOptions(dag), WithEncryption(testKeyProvider(t)))
+		},
+	}
+
+	for _, dag := range dags {
+		expect, err := CalculateCid(bytes.NewReader(content), WithDagOptions(dag))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expect.Prefix().MhType != dag.hashFunction() || expect.Version() != uint64(dag.CidVersion) {
+			t.Fatalf("%+v: unexpected root %s", dag, expect)
+		}
+
+		for name, upload := range uploads {
+			var carUploads [][]byte
+			srv := newUploadServer(t, http.StatusOK, &carUploads)
+			web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: srv.URL}}}
+			s := &storage{webAPI: web}
+
+			root, err := upload(s, dag)
+			if err != nil {
+				t.Fatalf("%s %+v: %v", name, dag, err)
+			}
+
+			if len(carUploads) != 1 {
+				t.Fatalf("%s %+v: got %d uploads, expected 1", name, dag, len(carUploads))
+			}
+
+			br, err := car.NewBlockReader(bytes.NewReader(carUploads[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(br.Roots) != 1 || !br.Roots[0].Equals(root) {
+				t.Fatalf("%s %+v: car roots %v, returned %s", name, dag, br.Roots, root)
+			}
+
+			// the encrypted content has another CID, but it is built with the same options
+			if name != "UploadStream encrypted" && !root.Equals(expect) {
+				t.Fatalf("%s %+v: root %s, expected %s", name, dag, root, expect)
+			}
+			if root.Prefix().MhType != dag.hashFunction() {
+				t.Fatalf("%s %+v: root %s is not hashed with the dag options", name, dag, root)
+			}
+		}
+	}
+}
+
+func TestCreateCarWithDagOptions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "photos")
+	for name, content := range map[string]string{
+		"a.txt":           "a",
+		"2024/b.txt":      "bb",
+		"2024/trip/c.txt": "ccc",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dag := range []DagOptions{{}, {CidVersion: 1, HashFunction: multihash.BLAKE3, Layout: DagTrickle}} {
+		carPath := filepath.Join(t.TempDir(), "photos.car")
+		root, err := createCar(dir, carPath, &dag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := os.Open(carPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// the car holds the whole dag under the root
+		carRoot, assetType, err := validateCar(f)
+		if err != nil {
+			t.Fatalf("%+v: %v", dag, err)
+		}
+		if !carRoot.Equals(root) || assetType != string(FileTypeFolder) {
+			t.Fatalf("%+v: car root %s %s, expected folder %s", dag, carRoot, assetType, root)
+		}
+		if root.Version() != uint64(dag.CidVersion) || root.Prefix().MhType != dag.hashFunction() {
+			t.Fatalf("%+v: root %s is not built with the dag options", dag, root)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/ipfs/go-cid"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// DedupPolicy decides what an upload does when the user already owns its content.
+// The root CID is computed locally before any byte is sent.
+type DedupPolicy int
+
+const (
+	// DedupForce uploads the content even if the user already owns it, this is the default
+	DedupForce DedupPolicy = iota
+	// DedupSkip returns the CID of the existing asset without uploading or registering anything
+	DedupSkip
+	// DedupRegister registers the existing content under the name and group of the request without uploading it
+	DedupRegister
+)
+
+// WithDedup sets the policy for content the user already owns.
+// Encrypted uploads are never deduplicated, every upload has its own data key.
+func WithDedup(policy DedupPolicy) RequestOption {
+	return requestSetting(func(o *requestSettings) {
+		o.dedup = policy
+	})
+}
+
+// skipUpload reports whether the upload of opts.AssetCID can be skipped under the dedup policy of opts.
+// With DedupRegister, the existing content is registered with the asset property of opts first,
+// and the response of the registration is returned when the scheduler wants the content uploaded to its endpoints.
+func (s *storage) skipUpload(ctx context.Context, opts *requestOptions) (bool, *client.CreateAssetRsp, error) {
+	if opts.dedup == DedupForce || opts.Encrypted {
+		return false, nil, nil
+	}
+
+	exists, err := s.ownsAsset(ctx, opts.AssetCID)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !exists {
+		return false, nil, nil
+	}
+
+	if opts.dedup == DedupSkip {
+		return true, nil, nil
+	}
+
+	req := client.CreateAssetReq{AssetProperty: opts.AssetProperty, AreaIDs: s.areas}
+	rsp, err := s.webAPI.CreateAsset(ctx, &req)
+	if err != nil {
+		return false, nil, fmt.Errorf("CreateAsset error %w", err)
+	}
+
+	// the scheduler wants the content again, so it is uploaded to the endpoints of this registration
+	if !rsp.IsAlreadyExist && len(rsp.Endpoints) > 0 {
+		log.Printf("asset %s is owned but the scheduler returned endpoints, upload it", opts.AssetCID)
+		return false, rsp, nil
+	}
+
+	return true, nil, nil
+}
+
+// ownsAsset reports whether the user already owns the asset rootCID
+func (s *storage) ownsAsset(ctx context.Context, rootCID string) (bool, error) {
+	root, err := cid.Decode(rootCID)
+	if err != nil {
+		return false, err
+	}
+
+	rsp, err := s.webAPI.ListAssets(ctx, 0, 0, 0, rootCID, 0)
+	if err != nil {
+		return false, fmt.Errorf("ListAssets error %w", err)
+	}
+
+	hash := root.Hash().String()
+	for _, overview := range rsp.AssetOverviews {
+		if overview.AssetRecord != nil && (overview.AssetRecord.CID == rootCID || overview.AssetRecord.Hash == hash) {
+			return true, nil
+		}
+		if overview.UserAssetDetail != nil && overview.UserAssetDetail.Hash == hash {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// dedupContent computes the root CID of the content of r the way the node does,
+// and reports whether its upload can be skipped under the dedup policy of opts
+func (s *storage) dedupContent(ctx context.Context, opts *requestOptions, r io.Reader, name string, size int64) (cid.Cid, bool, error) {
+	if opts.dedup == DedupForce || opts.Encrypted {
+		return cid.Cid{}, false, nil
+	}
+
+	root, err := CalculateCid(r)
+	if err != nil {
+		return cid.Cid{}, false, err
+	}
+
+	opts.AssetCID = root.String()
+	opts.AssetName = name
+	opts.AssetSize = size
+	opts.AssetType = string(FileTypeFile)
+
+	// the node upload registers the asset itself, the endpoints of a registration are not used
+	skip, _, err := s.skipUpload(ctx, opts)
+	if err != nil {
+		return cid.Cid{}, false, err
+	}
+
+	return root, skip, nil
+}
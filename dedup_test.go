@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+func TestUploadDedup(t *testing.T) {
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	root, err := CalculateCid(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		owned    []string
+		policy   DedupPolicy
+		uploaded bool
+		created  bool
+	}{
+		{name: "force", owned: []string{root.String()}, policy: DedupForce, uploaded: true, created: true},
+		{name: "skip", owned: []string{root.String()}, policy: DedupSkip},
+		{name: "register", owned: []string{root.String()}, policy: DedupRegister, created: true},
+		{name: "not owned", policy: DedupSkip, uploaded: true, created: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var uploads [][]byte
+			srv := newUploadServer(t, http.StatusOK, &uploads)
+
+			web := &fakeWebserver{uploadURL: srv.URL, owned: c.owned}
+			s := &storage{webAPI: web}
+
+			got, err := s.UploadStreamV2(context.Background(), bytes.NewReader(content), "export.txt", nil, WithDedup(c.policy), WithGroupID(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if uploaded := len(uploads) > 0; uploaded != c.uploaded {
+				t.Fatalf("uploaded %v, expected %v", uploaded, c.uploaded)
+			}
+			if created := len(web.created) > 0; created != c.created {
+				t.Fatalf("created %v, expected %v", created, c.created)
+			}
+
+			if !c.uploaded {
+				if !got.Equals(root) {
+					t.Fatalf("got %s, expected %s", got, root)
+				}
+				if c.created && (web.created[0].AssetName != "export.txt" || web.created[0].GroupID != 3 || web.created[0].AssetCID != root.String()) {
+					t.Fatalf("registered %+v", web.created[0])
+				}
+			}
+		})
+	}
+}
+
+func TestUploadDedupSkipsEncrypted(t *testing.T) {
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	root, err := CalculateCid(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := &fakeWebserver{uploadURL: srv.URL, owned: []string{root.String()}}
+	s := &storage{webAPI: web, keyProvider: testKeyProvider(t)}
+
+	if _, err := s.UploadStreamV2(context.Background(), bytes.NewReader(content), "export.txt", nil, WithDedup(DedupSkip), WithEncryption(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 1 {
+		t.Fatal("encrypted content was deduplicated")
+	}
+}
+
+func TestUploadDedupRegisterUploadsToItsEndpoints(t *testing.T) {
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	root, _, err := calculateCarV1(bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scheduler returns endpoints to the registration of owned content
+	web := &fakeWebserver{owned: []string{root.String()}, endpoints: []*client.Endpoint{{CandidateAddr: srv.URL}}}
+	s := &storage{webAPI: web}
+
+	got, err := s.UploadStream(context.Background(), bytes.NewReader(content), "export.txt", nil, WithDedup(DedupRegister))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Equals(root) || len(uploads) != 1 || len(web.created) != 1 {
+		t.Fatalf("expect one registration and one upload of %s, got %d and %d", root, len(web.created), len(uploads))
+	}
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// groupPageSize is the page size used to look up existing groups by name
+const groupPageSize = 100
+
+// DirectoryEntry is a file of a directory uploaded by UploadDirectory
+type DirectoryEntry struct {
+	// Path is relative to the uploaded directory and slash separated
+	Path    string
+	CID     string
+	GroupID int
+}
+
+// DirectoryManifest describes how a local directory was mirrored into groups
+type DirectoryManifest struct {
+	// GroupID is the group of the uploaded directory itself
+	GroupID int
+	// Groups maps the relative path of every directory to its group, "." is the uploaded directory
+	Groups map[string]int
+	Files  []*DirectoryEntry
+}
+
+// UploadDirectory mirrors the local directory dirPath into groups and uploads every file into the group of its directory.
+// The group of dirPath is created under the group set WithGroupID, or the group of the Config.
+// Groups that already exist with the same name under the same parent are reused.
+// If an upload fails, the manifest of the files uploaded so far is returned with the error.
+func (s *storage) UploadDirectory(ctx context.Context, dirPath string, progress ProgressFunc, options ...RequestOption) (*DirectoryManifest, error) {
+	opts := newRequestOptions(client.AssetProperty{GroupID: s.groupID}, options)
+
+	var totalSize int64
+	err := filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			totalSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rootGroup, err := s.ensureGroup(ctx, filepath.Base(filepath.Clean(dirPath)), opts.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &DirectoryManifest{GroupID: rootGroup, Groups: map[string]int{".": rootGroup}}
+
+	var doneSize int64
+	err = filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dirPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel == "." {
+			return nil
+		}
+
+		parent := manifest.Groups[path.Dir(rel)]
+
+		if d.IsDir() {
+			groupID, err := s.ensureGroup(ctx, d.Name(), parent)
+			if err != nil {
+				return fmt.Errorf("create group of %s: %w", rel, err)
+			}
+			manifest.Groups[rel] = groupID
+			return nil
+		}
+
+		// links and special files are not uploaded
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		fileProgress := func(done, total int64) {
+			if progress == nil {
+				return
+			}
+			// the uploaded size may differ from the file size, progress is counted in file bytes
+			if total > 0 {
+				done = int64(float64(done) / float64(total) * float64(info.Size()))
+			}
+			progress(doneSize+done, totalSize)
+		}
+
+		root, err := s.UploadAsset(ctx, p, nil, fileProgress, append(options[:len(options):len(options)], WithGroupID(parent))...)
+		if err != nil {
+			return fmt.Errorf("upload %s: %w", rel, err)
+		}
+
+		doneSize += info.Size()
+		manifest.Files = append(manifest.Files, &DirectoryEntry{Path: rel, CID: root.String(), GroupID: parent})
+		return nil
+	})
+
+	return manifest, err
+}
+
+// ensureGroup returns the id of the group name under parent, the group is created if it does not exist
+func (s *storage) ensureGroup(ctx context.Context, name string, parent int) (int, error) {
+	for page := 1; ; page++ {
+		rsp, err := s.webAPI.ListGroups(ctx, parent, groupPageSize, page)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, group := range rsp.AssetGroups {
+			if group.Name == name {
+				return group.ID, nil
+			}
+		}
+
+		if len(rsp.AssetGroups) < groupPageSize || page*groupPageSize >= rsp.Total {
+			break
+		}
+	}
+
+	group, err := s.webAPI.CreateGroup(ctx, name, parent)
+	if err != nil {
+		return 0, err
+	}
+
+	if group == nil {
+		return 0, fmt.Errorf("create group %s returned no group", name)
+	}
+
+	return group.ID, nil
+}
+
+// WithEntryNames sets the names of the paths given to UploadFiles in the wrapping directory, keyed by path.
+// A path without a name keeps its base name.
+func WithEntryNames(names map[string]string) RequestOption {
+	return requestSetting(func(o *requestSettings) {
+		o.entryNames = names
+	})
+}
+
+// UploadFiles uploads files and folders as a single folder asset, a unixfs directory holding every path.
+// If name is empty, name will be the root CID.
+func (s *storage) UploadFiles(ctx context.Context, paths []string, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
+	opts := newRequestOptions(client.AssetProperty{NodeID: s.candidateID, GroupID: s.groupID}, options)
+	if opts.Encrypted {
+		return cid.Cid{}, fmt.Errorf("encryption of a folder is not supported")
+	}
+
+	if len(paths) == 0 {
+		return cid.Cid{}, fmt.Errorf("paths can not empty")
+	}
+
+	names := make([]string, len(paths))
+	seen := make(map[string]string, len(paths))
+	for i, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			return cid.Cid{}, err
+		}
+
+		entryName := opts.entryNames[p]
+		if len(entryName) == 0 {
+			entryName = filepath.Base(p)
+		}
+
+		if entryName == "." || entryName == ".." || strings.ContainsAny(entryName, `/\`) {
+			return cid.Cid{}, fmt.Errorf("invalid name %q for %s", entryName, p)
+		}
+
+		if other, ok := seen[entryName]; ok {
+			return cid.Cid{}, fmt.Errorf("%s and %s have the same name %s", other, p, entryName)
+		}
+		seen[entryName] = p
+		names[i] = entryName
+	}
+
+	tempFile, err := os.CreateTemp("", "titan-files-*.car")
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	carPath := tempFile.Name()
+	tempFile.Close()
+	// blockstore.OpenReadWrite refuses to resume a car that is not a valid one
+	os.Remove(carPath)
+	defer os.Remove(carPath)
+
+	root, err := createWrappedCar(names, paths, carPath, opts.dag)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	carFile, err := os.Open(carPath)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer carFile.Close()
+
+	fileInfo, err := carFile.Stat()
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	if len(name) == 0 {
+		name = root.String()
+	}
+
+	opts.AssetCID = root.String()
+	opts.AssetName = name
+	opts.AssetSize = fileInfo.Size()
+	opts.AssetType = string(FileTypeFolder)
+
+	return s.registerAndUpload(ctx, root, opts, func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(carFile, 0, fileInfo.Size())), nil
+	}, progress)
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// directoryDownloadWorkers is the number of files of a folder downloaded in parallel
+	directoryDownloadWorkers = 4
+	// rawMediaType is the media type of a block response of a trustless gateway
+	rawMediaType = "application/vnd.ipld.raw"
+)
+
+// DownloadDirectory downloads the folder asset rootCID into destDir.
+// Without WithCarRetrieval, the blocks are fetched one by one from the nodes of the asset and verified against their CID,
+// WithCarRetrieval downloads the whole dag as a single car first.
+// The files are written in parallel and progress is called, never concurrently, as each of them is written.
+func (s *storage) DownloadDirectory(ctx context.Context, rootCID, destDir string, progress FileProgressFunc, options ...DownloadOption) error {
+	opts := newDownloadOptions(options)
+
+	root, err := cid.Decode(rootCID)
+	if err != nil {
+		return err
+	}
+
+	var lsys *ipld.LinkSystem
+	if opts.car {
+		dag, _, err := s.retrieveCar(ctx, rootCID)
+		if err != nil {
+			return err
+		}
+		defer dag.Close()
+		lsys = &dag.lsys
+	} else {
+		res, err := s.GetURL(ctx, rootCID)
+		if err != nil {
+			return err
+		}
+		lsys = blockLinkSystem(s.getNodeClient(), res.URLs)
+	}
+
+	node, err := loadUnixFSNode(ctx, lsys, root)
+	if err != nil {
+		return err
+	}
+
+	if !isDirectory(node) {
+		return fmt.Errorf("asset %s is not a folder", rootCID)
+	}
+
+	return writeDirectory(ctx, lsys, node, destDir, progress)
+}
+
+// blockLinkSystem loads the blocks of a dag from the nodes of urls with httpClient, every block is verified against its CID
+func blockLinkSystem(httpClient *http.Client, urls []string) *ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	// the blocks are verified by readBlock
+	lsys.TrustedStorage = true
+	lsys.StorageReadOpener = func(lc ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("not a cidlink")
+		}
+
+		// identity CIDs carry their data, they have no block
+		if cl.Cid.Prefix().MhType == multihash.IDENTITY {
+			dmh, err := multihash.Decode(cl.Cid.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(dmh.Digest), nil
+		}
+
+		ctx := lc.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var blk io.Reader
+		err := fetchFromNodes(ctx, httpClient, urls, cl.Cid, "raw", rawMediaType, func(body io.Reader) error {
+			rc, err := readBlock(cl.Cid, body)
+			blk = rc
+			return err
+		})
+		return blk, err
+	}
+	return &lsys
+}
+
+// directoryFile is a file found while walking a directory dag
+type directoryFile struct {
+	// path is the slash separated path of the file in the directory
+	path string
+	dest string
+	node datamodel.Node
+}
+
+// writeDirectory writes the unixfs directory node into destDir.
+// The directory tree is walked and its symlinks created while its files are written by parallel workers,
+// the first error stops the walk and the workers.
+func writeDirectory(ctx context.Context, lsys *ipld.LinkSystem, node datamodel.Node, destDir string, progress FileProgressFunc) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	p := &fileProgress{progress: progress}
+	files := make(chan directoryFile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < directoryDownloadWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := writeDirectoryFile(ctx, lsys, f, p); err != nil {
+					cancel(fmt.Errorf("write %s: %w", f.path, err))
+				}
+			}
+		}()
+	}
+
+	err := walkDirectoryTree(ctx, lsys, node, destDir, "", files)
+	close(files)
+	wg.Wait()
+
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// walkDirectoryTree creates the directory node at dest with its subdirectories and symlinks, and sends its files to files
+func walkDirectoryTree(ctx context.Context, lsys *ipld.LinkSystem, node datamodel.Node, dest, rel string, files chan<- directoryFile) error {
+	if err := checkNotSymlink(dest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+
+	return walkDirectory(ctx, lsys, node, func(name string, c cid.Cid) error {
+		child, err := loadUnixFSNode(ctx, lsys, c)
+		if err != nil {
+			return err
+		}
+
+		childDest, childRel := filepath.Join(dest, name), path.Join(rel, name)
+
+		if isDirectory(child) {
+			return walkDirectoryTree(ctx, lsys, child, childDest, childRel, files)
+		}
+
+		if target, ok := symlinkTarget(child); ok {
+			return os.Symlink(target, childDest)
+		}
+
+		select {
+		case files <- directoryFile{path: childRel, dest: childDest, node: child}:
+			return nil
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	})
+}
+
+// writeDirectoryFile writes the content of the file f, reporting its progress
+func writeDirectoryFile(ctx context.Context, lsys *ipld.LinkSystem, f directoryFile, p *fileProgress) error {
+	if err := checkNotSymlink(f.dest); err != nil {
+		return err
+	}
+
+	r, err := unixfsFileReader(ctx, lsys, f.node)
+	if err != nil {
+		return err
+	}
+
+	size := unixfsFileSize(f.node)
+	p.report(f.path, 0, size)
+
+	var done int64
+	return writeFileAt(f.dest, &ProgressReader{Reader: r, Reporter: func(n int64) {
+		if n > 0 {
+			done += n
+			p.report(f.path, done, size)
+		}
+	}})
+}
+
+// fileProgress serializes the progress reports of the files written in parallel
+type fileProgress struct {
+	mu       sync.Mutex
+	progress FileProgressFunc
+}
+
+func (p *fileProgress) report(path string, done, total int64) {
+	if p.progress == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress(path, done, total)
+}
+
+// checkNotSymlink fails if destPath is a symlink, an entry of a dag must not be written through a symlink made by another one
+func checkNotSymlink(destPath string) error {
+	if fi, err := os.Lstat(destPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", destPath)
+	}
+	return nil
+}
+
+// unixfsFileSize returns the size of the content of the unixfs file node, or -1 if it is unknown
+func unixfsFileSize(node datamodel.Node) int64 {
+	if node.Kind() == datamodel.Kind_Bytes {
+		b, err := node.AsBytes()
+		if err != nil {
+			return -1
+		}
+		return int64(len(b))
+	}
+
+	pbNode, ok := node.(dagpb.PBNode)
+	if !ok || !pbNode.FieldData().Exists() {
+		return -1
+	}
+
+	ufsData, err := data.DecodeUnixFSData(pbNode.FieldData().Must().Bytes())
+	if err != nil {
+		return -1
+	}
+
+	if ufsData.FieldFileSize().Exists() {
+		return ufsData.FieldFileSize().Must().Int()
+	}
+	if ufsData.FieldData().Exists() {
+		return int64(len(ufsData.FieldData().Must().Bytes()))
+	}
+	return 0
+}
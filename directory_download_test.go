@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// newBlockServer serves the blocks of dag like the raw format of a node, tamper alters the blocks holding it
+func newBlockServer(t *testing.T, dag *carDag, tamper []byte) (*httptest.Server, *atomic.Int64) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Query().Get("token") != "secret" || r.URL.Query().Get("format") != "raw" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		blk, err := dag.bs.Get(r.Context(), c)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		data := append([]byte(nil), blk.RawData()...)
+		if i := bytes.Index(data, tamper); len(tamper) > 0 && i >= 0 {
+			data[i] ^= 1
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestWriteDirectoryWithBlockFetches(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "folder")
+	large := make([]byte, 3<<20+17)
+	rand.Read(large)
+
+	files := map[string][]byte{
+		"large.bin":   large,
+		"a.txt":       []byte("a"),
+		"sub/b.txt":   []byte("b"),
+		"sub/c/d.txt": []byte("d"),
+		"sub/c/e.txt": []byte("e"),
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	carPath := filepath.Join(t.TempDir(), "folder.car")
+	root, err := createCar(src, carPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dag, err := newCarDag(f, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dag.Close()
+
+	srv, requests := newBlockServer(t, dag, nil)
+	// the first node rejects the token, the blocks are fetched from the second one
+	lsys := blockLinkSystem(http.DefaultClient, []string{srv.URL + "/ipfs/" + root.String() + "?token=wrong", srv.URL + "/ipfs/" + root.String() + "?token=secret"})
+
+	node, err := loadUnixFSNode(context.Background(), lsys, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress := make(map[string][2]int64)
+	dest := filepath.Join(t.TempDir(), "out")
+	err = writeDirectory(context.Background(), lsys, node, dest, func(path string, done, total int64) {
+		if last := progress[path]; done < last[0] {
+			t.Errorf("%s progress went back from %d to %d", path, last[0], done)
+		}
+		progress[path] = [2]int64{done, total}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%s differs", name)
+		}
+
+		size := int64(len(content))
+		if p := progress[name]; p != [2]int64{size, size} {
+			t.Fatalf("%s last progress %v, expected %d of %d", name, p, size, size)
+		}
+	}
+	if requests.Load() == 0 {
+		t.Fatal("no block was fetched")
+	}
+
+	// a node serving a block that does not hash to its CID
+	srv, _ = newBlockServer(t, dag, large[2<<20:2<<20+64])
+	lsys = blockLinkSystem(http.DefaultClient, []string{srv.URL + "/ipfs/" + root.String() + "?token=secret"})
+
+	err = writeDirectory(context.Background(), lsys, node, filepath.Join(t.TempDir(), "out"), nil)
+	var integrityErr *IntegrityError
+	if !errors.As(err, &integrityErr) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+func TestUploadDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "photos")
+	for name, content := range map[string]string{
+		"a.txt":            "a",
+		"2024/b.txt":       "bb",
+		"2024/trip/c.txt":  "ccc",
+		"2025/empty/.keep": "",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+
+	// the group of 2024 already exists under the group of the directory
+	web := &fakeWebserver{
+		uploadURL: srv.URL,
+		groups: []*client.AssetGroup{
+			{ID: 1, Name: "photos", Parent: 9},
+			{ID: 2, Name: "2024", Parent: 1},
+		},
+	}
+	s := &storage{webAPI: web}
+
+	var lastDone, lastTotal int64
+	manifest, err := s.UploadDirectory(context.Background(), dir, func(done, total int64) {
+		lastDone, lastTotal = done, total
+	}, WithGroupID(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if manifest.GroupID != 1 || manifest.Groups["2024"] != 2 {
+		t.Fatalf("existing groups were not reused: %+v", manifest.Groups)
+	}
+	if len(web.groups) != 5 {
+		t.Fatalf("got %d groups, expected 5", len(web.groups))
+	}
+
+	files := make(map[string]int)
+	for _, f := range manifest.Files {
+		files[f.Path] = f.GroupID
+	}
+	expected := map[string]int{
+		"a.txt":            manifest.Groups["."],
+		"2024/b.txt":       manifest.Groups["2024"],
+		"2024/trip/c.txt":  manifest.Groups["2024/trip"],
+		"2025/empty/.keep": manifest.Groups["2025/empty"],
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("manifest files %v, expected %v", files, expected)
+	}
+	for p, groupID := range expected {
+		if files[p] != groupID || groupID == 0 {
+			t.Fatalf("file %s in group %d, expected %d", p, files[p], groupID)
+		}
+	}
+
+	for i, req := range web.created {
+		if req.GroupID != files[manifest.Files[i].Path] {
+			t.Fatalf("asset %s created in group %d", req.AssetName, req.GroupID)
+		}
+	}
+
+	if lastTotal != 6 || lastDone != 6 {
+		t.Fatalf("progress %d/%d, expected 6/6", lastDone, lastTotal)
+	}
+}
+
+func TestUploadFiles(t *testing.T) {
+	base := t.TempDir()
+	for name, content := range map[string]string{
+		"a/report.csv":   "1,2,3",
+		"b/report.csv":   "4,5,6",
+		"c/logs/out.log": "ok",
+	} {
+		p := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := filepath.Join(base, "a", "report.csv")
+	b := filepath.Join(base, "b", "report.csv")
+	logs := filepath.Join(base, "c", "logs")
+
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: srv.URL}}}
+	s := &storage{webAPI: web}
+
+	if _, err := s.UploadFiles(context.Background(), []string{a, b}, "", nil); err == nil {
+		t.Fatal("files with the same name were uploaded")
+	}
+
+	root, err := s.UploadFiles(context.Background(), []string{a, b, logs}, "bundle", nil, WithEntryNames(map[string]string{b: "report-b.csv"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(web.created) != 1 || web.created[0].AssetType != string(FileTypeFolder) || web.created[0].AssetName != "bundle" {
+		t.Fatalf("unexpected asset %+v", web.created)
+	}
+
+	got, assetType, err := validateCar(bytes.NewReader(uploads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equals(root) || assetType != string(FileTypeFolder) {
+		t.Fatalf("uploaded car of %s %s, expected folder %s", got, assetType, root)
+	}
+
+	br, err := car.NewBlockReader(bytes.NewReader(uploads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for {
+		blk, err := br.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !blk.Cid().Equals(root) {
+			continue
+		}
+
+		node, err := decodeBlock(blk.Cid(), blk.RawData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := node.(dagpb.PBNode).FieldLinks().Iterator()
+		for !links.Done() {
+			_, link := links.Next()
+			names = append(names, link.FieldName().Must().String())
+		}
+		break
+	}
+
+	if strings.Join(names, ",") != "logs,report-b.csv,report.csv" {
+		t.Fatalf("directory entries %v", names)
+	}
+}
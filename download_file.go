@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+	byterange "github.com/utopiosphe/titan-storage-sdk/range"
+)
+
+const (
+	// downloadStateSuffix names the sidecar state of a file written by DownloadToFile
+	downloadStateSuffix = ".titan-download"
+	// downloadStateInterval is how often the sidecar state is saved, a crash loses at most the chunks of this interval
+	downloadStateInterval = time.Second
+)
+
+// downloadState is the sidecar state of a file written by DownloadToFile, it records the segments already on disk
+type downloadState struct {
+	CID       string              `json:"cid"`
+	Size      int64               `json:"size"`
+	Segments  []byterange.Segment `json:"segments"`
+	UpdatedAt time.Time           `json:"updated_at"`
+
+	path string
+	// file is synced before the state is saved, so a saved segment is always on disk
+	file *os.File
+}
+
+// loadDownloadState returns the state of a previous download of assetCID into file,
+// a missing or unreadable state, or the state of another asset, starts from scratch
+func loadDownloadState(path, assetCID string, file *os.File) *downloadState {
+	st := &downloadState{}
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(b, st); err != nil {
+			log.Printf("decode download state %s: %s, download from scratch", path, err.Error())
+		}
+	}
+
+	if st.CID != assetCID {
+		st = &downloadState{CID: assetCID}
+	}
+
+	st.path = path
+	st.file = file
+	return st
+}
+
+// Completed implements byterange.ResumeState
+func (st *downloadState) Completed(size int64) ([]byterange.Segment, error) {
+	if st.Size != size {
+		st.Size = size
+		st.Segments = nil
+	}
+	return st.Segments, nil
+}
+
+// Written implements byterange.ResumeState
+func (st *downloadState) Written(seg byterange.Segment) error {
+	st.Segments = byterange.MergeSegments(append(st.Segments, seg))
+
+	if time.Since(st.UpdatedAt) < downloadStateInterval {
+		return nil
+	}
+	return st.save()
+}
+
+// save syncs the file and writes the state to a temporary file before renaming it,
+// so a crash never leaves a truncated state file behind
+func (st *downloadState) save() error {
+	if err := st.file.Sync(); err != nil {
+		return err
+	}
+
+	st.UpdatedAt = time.Now()
+
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := st.path + ".tmp"
+	if err := os.WriteFile(tempPath, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, st.path)
+}
+
+func (st *downloadState) remove() error {
+	if err := os.Remove(st.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DownloadToFile downloads the asset into filePath, chunks are fetched in parallel and written in place.
+// The segments written are recorded in a sidecar state next to filePath,
+// so a download interrupted by an error, a cancellation or a crash only fetches the missing segments when it is called again.
+// Encrypted assets are decrypted once every segment is written.
+// WithVerification checks the content of the file against assetCID before it is decrypted,
+// a file that does not match is left without state so it is downloaded from scratch next time.
+// WithCarRetrieval downloads it with DownloadTrustless instead, without resuming.
+func (s *storage) DownloadToFile(ctx context.Context, assetCID, filePath string, options ...DownloadOption) error {
+	opts := newDownloadOptions(options)
+	if opts.car {
+		return s.DownloadTrustless(ctx, assetCID, filePath)
+	}
+
+	res, err := s.GetURL(ctx, assetCID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkDecryptable(assetCID, res); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state := loadDownloadState(filePath+downloadStateSuffix, assetCID, f)
+
+	start := time.Now()
+
+	r := s.newRange()
+	stop := watchDownload(r.Stats, opts.progress)
+	size, err := r.WriteFile(ctx, res.Copy2RangeFileReq(), f, state)
+	stop()
+
+	report := client.AssetTransferReq{
+		CostMs:       int64(time.Since(start).Milliseconds()),
+		TotalSize:    size,
+		TransferType: client.AssetTransferTypeDownload,
+		Cid:          assetCID,
+		State:        client.AssetTransferStateFailed,
+		TraceID:      res.TraceID,
+	}
+
+	if err == nil {
+		report.State = client.AssetTransferStateSuccess
+	}
+
+	if reportErr := s.webAPI.AssetTransferReport(context.Background(), report); reportErr != nil {
+		log.Printf("failed to send transfer report, %s", reportErr.Error())
+	}
+
+	if err != nil {
+		if saveErr := state.save(); saveErr != nil {
+			log.Printf("save download state of %s: %s", filePath, saveErr.Error())
+		}
+		return err
+	}
+
+	// a previous file at filePath may be longer
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if opts.verify {
+		if err := verifyFile(assetCID, io.NewSectionReader(f, 0, size), opts); err != nil {
+			if removeErr := state.remove(); removeErr != nil {
+				log.Printf("remove download state of %s: %s", filePath, removeErr.Error())
+			}
+			return err
+		}
+	}
+
+	return s.decryptFile(ctx, res.Encrypted, f, filePath, state)
+}
+
+// decryptFile replaces the encrypted content of f at filePath with its plain content, and removes the download state.
+// The content of a plain asset is left as is, unless it starts with an encryption header the scheduler did not report.
+func (s *storage) decryptFile(ctx context.Context, encrypted bool, f *os.File, filePath string, state *downloadState) error {
+	if !encrypted && !hasEncryptionHeader(io.NewSectionReader(f, 0, state.Size)) {
+		return state.remove()
+	}
+
+	if s.keyProvider == nil {
+		return ErrNoKeyProvider
+	}
+
+	plain, err := newDecryptReader(ctx, s.keyProvider, io.NopCloser(io.NewSectionReader(f, 0, state.Size)))
+	if err != nil {
+		return err
+	}
+
+	tempPath := filePath + ".titan-decrypt"
+	temp, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	if _, err := io.Copy(temp, plain); err != nil {
+		temp.Close()
+		return fmt.Errorf("decrypt %s: %w", filePath, err)
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	// without the state, a crash before the rename downloads the encrypted content again instead of trusting the plain one
+	if err := state.remove(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, filePath)
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	byterange "github.com/utopiosphe/titan-storage-sdk/range"
+)
+
+func TestDownloadStateResume(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file")
+	statePath := filePath + downloadStateSuffix
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	st := loadDownloadState(statePath, "cid-a", f)
+	if segs, _ := st.Completed(100); len(segs) != 0 {
+		t.Fatalf("new state has segments %v", segs)
+	}
+
+	for _, seg := range []byterange.Segment{{Start: 0, End: 10}, {Start: 20, End: 30}, {Start: 10, End: 20}, {Start: 50, End: 60}} {
+		if err := st.Written(seg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []byterange.Segment{{Start: 0, End: 30}, {Start: 50, End: 60}}
+
+	st = loadDownloadState(statePath, "cid-a", f)
+	if segs, _ := st.Completed(100); !reflect.DeepEqual(segs, expect) {
+		t.Fatalf("got segments %v, expected %v", segs, expect)
+	}
+
+	// the file changed on titan, or it is another asset
+	if segs, _ := loadDownloadState(statePath, "cid-a", f).Completed(200); len(segs) != 0 {
+		t.Fatalf("state of another size has segments %v", segs)
+	}
+	if segs, _ := loadDownloadState(statePath, "cid-b", f).Completed(100); len(segs) != 0 {
+		t.Fatalf("state of another asset has segments %v", segs)
+	}
+}
+
+func TestDownloadToFileDecrypts(t *testing.T) {
+	kp := testKeyProvider(t)
+	plain := bytes.Repeat([]byte("titan"), encryptionFrameSize)
+	encrypted := encryptForTest(t, kp, plain)
+
+	filePath := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(filePath, encrypted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	st := loadDownloadState(filePath+downloadStateSuffix, "cid", f)
+	st.Completed(int64(len(encrypted)))
+	if err := st.Written(byterange.Segment{Start: 0, End: int64(len(encrypted))}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &storage{keyProvider: kp}
+	if err := s.decryptFile(context.Background(), true, f, filePath, st); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("file is not decrypted")
+	}
+
+	if _, err := os.Stat(st.path); !os.IsNotExist(err) {
+		t.Fatalf("download state is not removed: %v", err)
+	}
+}
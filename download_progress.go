@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	byterange "github.com/utopiosphe/titan-storage-sdk/range"
+)
+
+// downloadProgressInterval is the interval between two calls of a DownloadProgressFunc
+const downloadProgressInterval = 500 * time.Millisecond
+
+// DownloadProgressFunc is a function type for reporting progress during file downloads,
+// with the rate, the ETA and the bytes delivered and the failures of every node
+type DownloadProgressFunc func(stats byterange.Stats)
+
+// WithDownloadProgress reports the progress of DownloadAsset, GetFileWithCid and DownloadToFile to progress.
+// It is called every 500ms while the ranges are fetched, and once more when the download stops.
+// Car retrievals are not reported.
+func WithDownloadProgress(progress DownloadProgressFunc) DownloadOption {
+	return func(o *downloadOptions) {
+		o.progress = progress
+	}
+}
+
+// StatsReader is implemented by the readers of DownloadAsset and GetFileWithCid for the range downloads
+type StatsReader interface {
+	io.ReadCloser
+	// Stats returns the stats of the download, Done counts the bytes fetched, not the bytes read
+	Stats() byterange.Stats
+}
+
+// statsReader exposes the stats of the download of its reader, closing it stops the progress reports
+type statsReader struct {
+	io.ReadCloser
+	stats func() byterange.Stats
+	// stop ends the progress reports of the download
+	stop func()
+}
+
+func (r *statsReader) Stats() byterange.Stats {
+	return r.stats()
+}
+
+func (r *statsReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.stop()
+	return err
+}
+
+// watchDownload calls progress with the stats of a download every downloadProgressInterval until it is finished or stop is called,
+// stop calls it a last time if the download was not finished yet
+func watchDownload(stats func() byterange.Stats, progress DownloadProgressFunc) (stop func()) {
+	if progress == nil {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(downloadProgressInterval)
+	return watchTicks(stats, progress, ticker.C, ticker.Stop)
+}
+
+// watchTicks calls progress with the stats of a download on every tick, release is called once it stops
+func watchTicks(stats func() byterange.Stats, progress DownloadProgressFunc, ticks <-chan time.Time, release func()) (stop func()) {
+	var (
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+		once    sync.Once
+	)
+
+	go func() {
+		defer close(stopped)
+		defer release()
+
+		for {
+			select {
+			case <-ticks:
+				st := stats()
+				progress(st)
+				if st.Finished {
+					return
+				}
+			case <-done:
+				progress(stats())
+				return
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
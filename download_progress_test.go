@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	byterange "github.com/utopiosphe/titan-storage-sdk/range"
+)
+
+func TestWatchDownload(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current byterange.Stats
+	)
+	stats := func() byterange.Stats {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	set := func(st byterange.Stats) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = st
+	}
+	reports := make(chan byterange.Stats, 10)
+	progress := func(st byterange.Stats) {
+		reports <- st
+	}
+
+	// a download that finishes on its own
+	set(byterange.Stats{Done: 5, Total: 10})
+	ticks := make(chan time.Time)
+	released := make(chan struct{})
+	stop := watchTicks(stats, progress, ticks, func() { close(released) })
+
+	ticks <- time.Now()
+	if st := <-reports; st.Done != 5 || st.Finished {
+		t.Fatalf("unexpected report %+v", st)
+	}
+
+	set(byterange.Stats{Done: 10, Total: 10, Finished: true})
+	ticks <- time.Now()
+	if st := <-reports; !st.Finished {
+		t.Fatalf("unexpected report %+v", st)
+	}
+	<-released
+
+	// the watch already stopped, nothing is reported anymore
+	stop()
+	if len(reports) != 0 {
+		t.Fatalf("got %d reports after the end of the download", len(reports))
+	}
+
+	// a download stopped before the first tick is still reported once
+	stop = watchTicks(stats, progress, make(chan time.Time), func() {})
+	stop()
+	stop()
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports after stop, expected 1", len(reports))
+	}
+	<-reports
+
+	// closing the reader of the download stops the reports
+	r := &statsReader{ReadCloser: io.NopCloser(strings.NewReader("")), stats: stats, stop: watchDownload(stats, progress)}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports after close, expected 1", len(reports))
+	}
+
+	watchDownload(stats, nil)()
+}
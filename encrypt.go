@@ -0,0 +1,638 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+const (
+	encryptionMagic   = "TTNE"
+	encryptionVersion = 1
+	// plaintext size of a frame, every frame is sealed on its own so ranges can be decrypted
+	encryptionFrameSize = 64 << 10
+	dataKeySize         = 32
+	noncePrefixSize     = 4
+)
+
+var (
+	// ErrNoKeyProvider is returned when an encrypted upload or download has no KeyProvider for its data key
+	ErrNoKeyProvider = errors.New("encryption requires a KeyProvider")
+	// ErrMissingEncryptionHeader is returned when the content of an encrypted asset does not start with an encryption header
+	ErrMissingEncryptionHeader = errors.New("encrypted content has no encryption header")
+)
+
+// KeyProvider wraps the data key of every encrypted asset with a key encryption key.
+// The wrapped data key is stored in the header of the encrypted content,
+// so the key encryption key never leaves the provider.
+type KeyProvider interface {
+	// WrapKey encrypts dek and returns the id of the key encryption key that was used
+	WrapKey(ctx context.Context, dek []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped by the key encryption key keyID
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// staticKeyProvider wraps data keys with a single AES-GCM key held in memory
+type staticKeyProvider struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewStaticKeyProvider returns a KeyProvider wrapping data keys with kek,
+// kek must be 16, 24 or 32 bytes long
+func NewStaticKeyProvider(keyID string, kek []byte) (KeyProvider, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staticKeyProvider{keyID: keyID, aead: aead}, nil
+}
+
+func (p *staticKeyProvider) WrapKey(ctx context.Context, dek []byte) (string, []byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	return p.keyID, p.aead.Seal(nonce, nonce, dek, []byte(p.keyID)), nil
+}
+
+func (p *staticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != p.keyID {
+		return nil, fmt.Errorf("unknown key id %s", keyID)
+	}
+
+	if len(wrapped) < p.aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+
+	nonce, sealed := wrapped[:p.aead.NonceSize()], wrapped[p.aead.NonceSize():]
+	return p.aead.Open(nil, nonce, sealed, []byte(keyID))
+}
+
+// WithEncryption encrypts the content before it is uploaded, with a data key wrapped by kp.
+// If kp is nil, the KeyProvider of the Config is used.
+// Folders can not be encrypted.
+func WithEncryption(kp KeyProvider) RequestOption {
+	setKeyProvider := requestSetting(func(o *requestSettings) {
+		o.keyProvider = kp
+	})
+	return func(ap *client.AssetProperty) {
+		ap.Encrypted = true
+		setKeyProvider(ap)
+	}
+}
+
+// encryptionHeader starts the encrypted content, it is bound to every frame as additional data
+//
+//	magic | version | frame size | plaintext size | key id | wrapped key | nonce prefix
+type encryptionHeader struct {
+	frameSize   uint32
+	size        int64
+	keyID       string
+	wrappedKey  []byte
+	noncePrefix [noncePrefixSize]byte
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(encryptionMagic)
+	buf.WriteByte(encryptionVersion)
+	binary.Write(&buf, binary.BigEndian, h.frameSize)
+	binary.Write(&buf, binary.BigEndian, h.size)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.keyID)))
+	buf.WriteString(h.keyID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.wrappedKey)))
+	buf.Write(h.wrappedKey)
+	buf.Write(h.noncePrefix[:])
+	return buf.Bytes()
+}
+
+// readEncryptionHeader reads the header after the magic and returns it with its raw bytes
+func readEncryptionHeader(r io.Reader) (*encryptionHeader, []byte, error) {
+	var (
+		raw     bytes.Buffer
+		h       = &encryptionHeader{}
+		version uint8
+		keyLen  uint16
+	)
+	raw.WriteString(encryptionMagic)
+	tr := io.TeeReader(r, &raw)
+
+	if err := binary.Read(tr, binary.BigEndian, &version); err != nil {
+		return nil, nil, err
+	}
+	if version != encryptionVersion {
+		return nil, nil, fmt.Errorf("unsupported encryption version %d", version)
+	}
+
+	if err := binary.Read(tr, binary.BigEndian, &h.frameSize); err != nil {
+		return nil, nil, err
+	}
+	if err := binary.Read(tr, binary.BigEndian, &h.size); err != nil {
+		return nil, nil, err
+	}
+	if h.frameSize == 0 || h.size < 0 {
+		return nil, nil, fmt.Errorf("invalid encryption header")
+	}
+
+	if err := binary.Read(tr, binary.BigEndian, &keyLen); err != nil {
+		return nil, nil, err
+	}
+	keyID := make([]byte, keyLen)
+	if _, err := io.ReadFull(tr, keyID); err != nil {
+		return nil, nil, err
+	}
+	h.keyID = string(keyID)
+
+	if err := binary.Read(tr, binary.BigEndian, &keyLen); err != nil {
+		return nil, nil, err
+	}
+	h.wrappedKey = make([]byte, keyLen)
+	if _, err := io.ReadFull(tr, h.wrappedKey); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := io.ReadFull(tr, h.noncePrefix[:]); err != nil {
+		return nil, nil, err
+	}
+
+	return h, raw.Bytes(), nil
+}
+
+// frameCipher seals and opens the frames of an encrypted content
+type frameCipher struct {
+	header *encryptionHeader
+	raw    []byte
+	aead   cipher.AEAD
+	frames int64
+}
+
+func newFrameCipher(header *encryptionHeader, raw []byte, dek []byte) (*frameCipher, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty content still has one frame, so the header is always authenticated
+	frames := (header.size + int64(header.frameSize) - 1) / int64(header.frameSize)
+	if frames == 0 {
+		frames = 1
+	}
+
+	return &frameCipher{header: header, raw: raw, aead: aead, frames: frames}, nil
+}
+
+func (c *frameCipher) nonce(index int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, c.header.noncePrefix[:])
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], uint64(index))
+	return nonce
+}
+
+// additionalData binds a frame to the header, its index and whether it is the last one,
+// so frames can not be reordered, truncated or moved to another content
+func (c *frameCipher) additionalData(index int64) []byte {
+	ad := make([]byte, 0, len(c.raw)+9)
+	ad = append(ad, c.raw...)
+	ad = binary.BigEndian.AppendUint64(ad, uint64(index))
+	if index == c.frames-1 {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// frameLen returns the plaintext length of frame index
+func (c *frameCipher) frameLen(index int64) int64 {
+	if index == c.frames-1 {
+		return c.header.size - index*int64(c.header.frameSize)
+	}
+	return int64(c.header.frameSize)
+}
+
+// frameOffset returns the offset of frame index in the encrypted content
+func (c *frameCipher) frameOffset(index int64) int64 {
+	return int64(len(c.raw)) + index*(int64(c.header.frameSize)+int64(c.aead.Overhead()))
+}
+
+// encryptedSize returns the size of the encrypted content
+func (c *frameCipher) encryptedSize() int64 {
+	return int64(len(c.raw)) + c.header.size + c.frames*int64(c.aead.Overhead())
+}
+
+// newEncryptor creates the cipher of a content of size bytes with a fresh data key
+func newEncryptor(ctx context.Context, kp KeyProvider, size int64) (*frameCipher, error) {
+	dek := make([]byte, dataKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := kp.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+
+	if len(keyID) > math.MaxUint16 || len(wrapped) > math.MaxUint16 {
+		return nil, fmt.Errorf("wrapped key too long")
+	}
+
+	header := &encryptionHeader{frameSize: encryptionFrameSize, size: size, keyID: keyID, wrappedKey: wrapped}
+	if _, err := rand.Read(header.noncePrefix[:]); err != nil {
+		return nil, err
+	}
+
+	return newFrameCipher(header, header.marshal(), dek)
+}
+
+// encryptor returns the cipher for an upload, or nil if the upload is not encrypted
+func (s *storage) encryptor(ctx context.Context, opts *requestOptions, size int64) (*frameCipher, error) {
+	if !opts.Encrypted {
+		return nil, nil
+	}
+
+	kp := s.requestKeyProvider(opts)
+	if kp == nil {
+		return nil, ErrNoKeyProvider
+	}
+
+	return newEncryptor(ctx, kp, size)
+}
+
+// requestKeyProvider returns the KeyProvider of WithEncryption, or the one of the Config
+func (s *storage) requestKeyProvider(opts *requestOptions) KeyProvider {
+	if opts.keyProvider != nil {
+		return opts.keyProvider
+	}
+	return s.keyProvider
+}
+
+// Reader returns the encrypted content of r, r must hold exactly the size of the header.
+// The same cipher always produces the same encrypted content, so it can be read more than once.
+func (c *frameCipher) Reader(r io.Reader) io.Reader {
+	return &encryptReader{c: c, r: r, buf: c.raw}
+}
+
+type encryptReader struct {
+	c     *frameCipher
+	r     io.Reader
+	buf   []byte
+	index int64
+	err   error
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		e.err = e.next()
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// next seals the next frame into buf
+func (e *encryptReader) next() error {
+	if e.index == e.c.frames {
+		// the source must not hold more than the size of the header
+		if n, _ := e.r.Read(make([]byte, 1)); n > 0 {
+			return fmt.Errorf("content is longer than %d bytes", e.c.header.size)
+		}
+		return io.EOF
+	}
+
+	plain := make([]byte, e.c.frameLen(e.index))
+	if _, err := io.ReadFull(e.r, plain); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("content is shorter than %d bytes", e.c.header.size)
+		}
+		return err
+	}
+
+	e.buf = e.c.aead.Seal(nil, e.c.nonce(e.index), plain, e.c.additionalData(e.index))
+	e.index++
+	return nil
+}
+
+// encryptedSource is the encrypted content of a source
+type encryptedSource struct {
+	source contentSource
+	c      *frameCipher
+}
+
+func (s *encryptedSource) Open() io.Reader {
+	return s.c.Reader(s.source.Open())
+}
+
+func (s *encryptedSource) Size() int64 {
+	return s.c.encryptedSize()
+}
+
+// openFrame decrypts frame index
+func (c *frameCipher) openFrame(index int64, sealed []byte) ([]byte, error) {
+	plain, err := c.aead.Open(nil, c.nonce(index), sealed, c.additionalData(index))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt frame %d: %w", index, err)
+	}
+	return plain, nil
+}
+
+// decryptReader decrypts an encrypted content read from r
+type decryptReader struct {
+	c     *frameCipher
+	r     io.Reader
+	close func() error
+	buf   []byte
+	index int64
+	err   error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	if d.index == d.c.frames {
+		return io.EOF
+	}
+
+	sealed := make([]byte, d.c.frameLen(d.index)+int64(d.c.aead.Overhead()))
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plain, err := d.c.openFrame(d.index, sealed)
+	if err != nil {
+		return err
+	}
+
+	d.buf = plain
+	d.index++
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	if d.close == nil {
+		return nil
+	}
+	return d.close()
+}
+
+// Size returns the size of the decrypted content
+func (d *decryptReader) Size() int64 {
+	return d.c.header.size
+}
+
+// decryptReaderAt also decrypts ranges of the content, only the frames overlapping a range are read
+type decryptReaderAt struct {
+	*decryptReader
+	ra io.ReaderAt
+}
+
+func (d *decryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+
+	frameSize := int64(d.c.header.frameSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= d.c.header.size {
+			return n, io.EOF
+		}
+
+		index := pos / frameSize
+		sealed := make([]byte, d.c.frameLen(index)+int64(d.c.aead.Overhead()))
+		if _, err := d.ra.ReadAt(sealed, d.c.frameOffset(index)); err != nil && !(errors.Is(err, io.EOF) && index == d.c.frames-1) {
+			return n, err
+		}
+
+		plain, err := d.c.openFrame(index, sealed)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], plain[pos-index*frameSize:])
+	}
+
+	return n, nil
+}
+
+// newDecryptReader decrypts rc, which must start with an encryption header.
+// If rc is also an io.ReaderAt, the returned reader decrypts ranges too.
+func newDecryptReader(ctx context.Context, kp KeyProvider, rc io.ReadCloser) (io.ReadCloser, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(rc, magic); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	if string(magic) != encryptionMagic {
+		return nil, ErrMissingEncryptionHeader
+	}
+
+	header, raw, err := readEncryptionHeader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("read encryption header: %w", err)
+	}
+
+	dek, err := kp.UnwrapKey(ctx, header.keyID, header.wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+
+	c, err := newFrameCipher(header, raw, dek)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{c: c, r: rc, close: rc.Close}
+	if ra, ok := rc.(io.ReaderAt); ok {
+		return &decryptReaderAt{decryptReader: d, ra: ra}, nil
+	}
+	return d, nil
+}
+
+// uploadEncryptedFile makes the car of the encrypted content of a file and uploads it
+func (s *storage) uploadEncryptedFile(ctx context.Context, filePath string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
+	fileType, err := getFileType(filePath)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	if fileType == string(FileTypeFolder) {
+		return cid.Cid{}, fmt.Errorf("encryption of folder %s is not supported", filePath)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer f.Close()
+
+	return s.UploadStream(ctx, f, filepath.Base(filePath), progress, options...)
+}
+
+// openPlainContent returns the content of a file or a stream that can be read more than once, release frees what it holds
+func openPlainContent(filePath string, reader io.Reader) (contentSource, func() error, error) {
+	closeFile := func() error { return nil }
+
+	if filePath != "" {
+		fileType, err := getFileType(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if fileType == string(FileTypeFolder) {
+			return nil, nil, fmt.Errorf("encryption of folder %s is not supported", filePath)
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, closeFile = f, f.Close
+	}
+
+	if reader == nil {
+		return nil, nil, fmt.Errorf("FilePath or Reader must be non empty")
+	}
+
+	source, err := newReplayableSource(reader)
+	if err != nil {
+		closeFile()
+		return nil, nil, err
+	}
+
+	release := func() error {
+		closeFile()
+		return source.Close()
+	}
+
+	return source, release, nil
+}
+
+// plainContentMAC authenticates the plain content of an encrypted upload with the options of its dag under key,
+// the same content encrypted with another data key makes another car, but has the same MAC
+func plainContentMAC(key []byte, source contentSource, dag *DagOptions) (string, error) {
+	h := hmac.New(sha256.New, key)
+
+	b, err := json.Marshal(dag)
+	if err != nil {
+		return "", err
+	}
+	h.Write(b)
+
+	if _, err := io.Copy(h, source.Open()); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkDecryptable returns ErrNoKeyProvider if the asset of res is encrypted and the storage cannot decrypt it
+func (s *storage) checkDecryptable(assetCID string, res *client.ShareAssetResult) error {
+	if res.Encrypted && s.keyProvider == nil {
+		return fmt.Errorf("asset %s: %w", assetCID, ErrNoKeyProvider)
+	}
+	return nil
+}
+
+// decryptDownload decrypts a downloaded asset if it is encrypted, plain assets are returned as is.
+// An asset the scheduler does not report as encrypted is still decrypted if it starts with an encryption header.
+func (s *storage) decryptDownload(ctx context.Context, encrypted bool, rc io.ReadCloser) (io.ReadCloser, error) {
+	if rc == nil {
+		return rc, nil
+	}
+
+	if !encrypted {
+		if rc, encrypted = peekEncryptionHeader(rc); !encrypted {
+			return rc, nil
+		}
+	}
+
+	if s.keyProvider == nil {
+		rc.Close()
+		return nil, ErrNoKeyProvider
+	}
+
+	r, err := newDecryptReader(ctx, s.keyProvider, rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// hasEncryptionHeader reports whether r starts with a valid encryption header
+func hasEncryptionHeader(r io.Reader) bool {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptionMagic {
+		return false
+	}
+
+	_, _, err := readEncryptionHeader(r)
+	return err == nil
+}
+
+// peekEncryptionHeader reports whether rc starts with a valid encryption header,
+// the returned reader still reads the content from its beginning
+func peekEncryptionHeader(rc io.ReadCloser) (io.ReadCloser, bool) {
+	if ra, ok := rc.(io.ReaderAt); ok {
+		return rc, hasEncryptionHeader(io.NewSectionReader(ra, 0, math.MaxInt64))
+	}
+
+	var peeked bytes.Buffer
+	encrypted := hasEncryptionHeader(io.TeeReader(rc, &peeked))
+	return readCloser{Reader: io.MultiReader(&peeked, rc), close: rc.Close}, encrypted
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"testing"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error { return nil }
+
+func testKeyProvider(t *testing.T) KeyProvider {
+	kp, err := NewStaticKeyProvider("test", bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+func encryptForTest(t *testing.T, kp KeyProvider, plain []byte) []byte {
+	c, err := newEncryptor(context.Background(), kp, int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := io.ReadAll(c.Reader(bytes.NewReader(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(encrypted)) != c.encryptedSize() {
+		t.Fatalf("encrypted %d bytes, expected %d", len(encrypted), c.encryptedSize())
+	}
+	return encrypted
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	kp := testKeyProvider(t)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, encryptionFrameSize, encryptionFrameSize + 1, 3*encryptionFrameSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		encrypted := encryptForTest(t, kp, plain)
+
+		// sequential reads
+		r, err := newDecryptReader(ctx, kp, io.NopCloser(bytes.NewReader(encrypted)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted content differs", size)
+		}
+
+		// ranged reads
+		r, err = newDecryptReader(ctx, kp, bytesReadCloser{bytes.NewReader(encrypted)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ra, ok := r.(io.ReaderAt)
+		if !ok {
+			t.Fatal("decrypted reader of a io.ReaderAt is not a io.ReaderAt")
+		}
+		for i := 0; i < 20 && size > 0; i++ {
+			off := rand.Intn(size)
+			buf := make([]byte, rand.Intn(2*encryptionFrameSize)+1)
+			n, err := ra.ReadAt(buf, int64(off))
+			if err != nil && !(errors.Is(err, io.EOF) && off+len(buf) > size) {
+				t.Fatalf("size %d: ReadAt(%d, %d): %v", size, len(buf), off, err)
+			}
+			if !bytes.Equal(buf[:n], plain[off:off+n]) {
+				t.Fatalf("size %d: ReadAt(%d, %d) content differs", size, len(buf), off)
+			}
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	kp := testKeyProvider(t)
+	ctx := context.Background()
+
+	plain := bytes.Repeat([]byte("titan"), encryptionFrameSize)
+	encrypted := encryptForTest(t, kp, plain)
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)/2] ^= 1
+
+	truncated := encrypted[:len(encrypted)-encryptionFrameSize-16]
+
+	for name, content := range map[string][]byte{"tampered": tampered, "truncated": truncated} {
+		r, err := newDecryptReader(ctx, kp, io.NopCloser(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Fatalf("%s content was decrypted", name)
+		}
+	}
+}
+
+func TestDecryptDownloadFollowsMetadata(t *testing.T) {
+	kp := testKeyProvider(t)
+	// plain content that only starts with the magic is not taken for encrypted content
+	plain := []byte(encryptionMagic + " plain content")
+
+	s := &storage{keyProvider: kp}
+	r, err := s.decryptDownload(context.Background(), false, io.NopCloser(bytes.NewReader(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("got %q, expected %q", got, plain)
+	}
+
+	if _, err := s.decryptDownload(context.Background(), true, io.NopCloser(bytes.NewReader([]byte("plain content")))); !errors.Is(err, ErrMissingEncryptionHeader) {
+		t.Fatalf("expected ErrMissingEncryptionHeader, got %v", err)
+	}
+
+	encrypted := encryptForTest(t, kp, plain)
+
+	// an encrypted asset the scheduler does not report is still decrypted, from a stream or a ReaderAt
+	for _, rc := range []io.ReadCloser{io.NopCloser(bytes.NewReader(encrypted)), bytesReadCloser{bytes.NewReader(encrypted)}} {
+		r, err := s.decryptDownload(context.Background(), false, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("got %q, %v, expected %q", got, err, plain)
+		}
+	}
+
+	s = &storage{}
+	if _, err := s.decryptDownload(context.Background(), false, io.NopCloser(bytes.NewReader(encrypted))); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected ErrNoKeyProvider, got %v", err)
+	}
+	if _, err := s.decryptDownload(context.Background(), true, io.NopCloser(bytes.NewReader(encrypted))); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected ErrNoKeyProvider, got %v", err)
+	}
+	if err := s.checkDecryptable("cid", &client.ShareAssetResult{Encrypted: true}); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected ErrNoKeyProvider, got %v", err)
+	}
+	if err := s.checkDecryptable("cid", &client.ShareAssetResult{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadStreamWithEncryption(t *testing.T) {
+	var uploads [][]byte
+	working := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: working.URL}}}
+	s := &storage{webAPI: web}
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	if _, err := s.UploadStream(context.Background(), bytes.NewReader(content), "titan.txt", nil, WithEncryption(nil)); !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected ErrNoKeyProvider, got %v", err)
+	}
+
+	s.keyProvider = testKeyProvider(t)
+	if _, err := s.UploadStream(context.Background(), bytes.NewReader(content), "titan.txt", nil, WithEncryption(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(web.created) != 1 || !web.created[0].Encrypted {
+		t.Fatalf("asset is not created as encrypted: %+v", web.created)
+	}
+	if len(uploads) != 1 || bytes.Contains(uploads[0], content[:64]) {
+		t.Fatal("uploaded car holds the plain content")
+	}
+}
@@ -44,6 +44,14 @@ func DeleteGroup(groupID int) error {
 	return storage_api.DeleteGroup(context.Background(), groupID)
 }
 
+func MoveFolder(folderID, targetParent int) error {
+	return storage_api.MoveFolder(context.Background(), folderID, targetParent)
+}
+
+func MoveAsset(rootCID string, targetGroup int) error {
+	return storage_api.MoveAsset(context.Background(), rootCID, targetGroup)
+}
+
 func ListUserAssets(parent, pageSize, page int) (resp string, err error) {
 	originResp, err1 := storage_api.ListUserAssets(context.Background(), parent, pageSize, page)
 	if err1 != nil {
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrMoveCycle is returned by MoveFolder when the target parent is the folder itself or one of its subfolders
+var ErrMoveCycle = errors.New("folder can not be moved into itself or one of its subfolders")
+
+// MoveAsset moves the asset assetCID into the group targetGroup, 0 is the root
+func (s *storage) MoveAsset(ctx context.Context, assetCID string, targetGroup int) error {
+	if len(assetCID) == 0 {
+		return fmt.Errorf("asset cid can not empty")
+	}
+	if targetGroup < 0 {
+		return fmt.Errorf("invalid target group %d", targetGroup)
+	}
+	return s.webAPI.MoveAssetToGroup(ctx, s.userID, assetCID, targetGroup)
+}
+
+// MoveFolder moves the group folderID with its content under the group targetParent, 0 is the root.
+// The subfolders of folderID are walked first, the move fails with ErrMoveCycle if targetParent is one of them.
+func (s *storage) MoveFolder(ctx context.Context, folderID, targetParent int) error {
+	if folderID <= 0 {
+		return fmt.Errorf("invalid folder %d", folderID)
+	}
+	if targetParent < 0 {
+		return fmt.Errorf("invalid target parent %d", targetParent)
+	}
+
+	if targetParent != 0 {
+		inside, err := s.isSubfolder(ctx, folderID, targetParent)
+		if err != nil {
+			return err
+		}
+		if inside {
+			return fmt.Errorf("move folder %d to %d: %w", folderID, targetParent, ErrMoveCycle)
+		}
+	}
+
+	return s.webAPI.MoveAssetGroup(ctx, s.userID, folderID, targetParent)
+}
+
+// isSubfolder reports whether group is folderID or one of the groups below it.
+// The groups have no lookup of their parent, so the subtree of folderID is listed until group shows up.
+// A concurrent move may still create a cycle, it is rejected by the web API.
+func (s *storage) isSubfolder(ctx context.Context, folderID, group int) (bool, error) {
+	if group == folderID {
+		return true, nil
+	}
+
+	// visited guards the walk against a tree that is already inconsistent
+	visited := map[int]bool{folderID: true}
+	queue := []int{folderID}
+
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for page := 1; ; page++ {
+			rsp, err := s.webAPI.ListGroups(ctx, parent, groupPageSize, page)
+			if err != nil {
+				return false, err
+			}
+
+			for _, child := range rsp.AssetGroups {
+				if child.ID == group {
+					return true, nil
+				}
+				if !visited[child.ID] {
+					visited[child.ID] = true
+					queue = append(queue, child.ID)
+				}
+			}
+
+			if len(rsp.AssetGroups) < groupPageSize || page*groupPageSize >= rsp.Total {
+				break
+			}
+		}
+	}
+
+	return false, nil
+}
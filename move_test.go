@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+func (f *fakeWebserver) MoveAssetToGroup(ctx context.Context, userID, cid string, groupID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.moved = append(f.moved, cid)
+	return nil
+}
+
+func (f *fakeWebserver) MoveAssetGroup(ctx context.Context, userID string, groupID, targetGroupID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, group := range f.groups {
+		if group.ID == groupID {
+			group.Parent = targetGroupID
+			return nil
+		}
+	}
+	return client.ErrAssetNotFound
+}
+
+func (f *fakeWebserver) listedGroups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+func TestMoveFolder(t *testing.T) {
+	// 1 -> 2 -> 3, and 4 at the root
+	web := &fakeWebserver{
+		groups: []*client.AssetGroup{
+			{ID: 1, Name: "a"},
+			{ID: 2, Name: "b", Parent: 1},
+			{ID: 3, Name: "c", Parent: 2},
+			{ID: 4, Name: "d"},
+		},
+	}
+	s := &storage{webAPI: web}
+	ctx := context.Background()
+
+	for _, target := range []int{1, 2, 3} {
+		if err := s.MoveFolder(ctx, 1, target); !errors.Is(err, ErrMoveCycle) {
+			t.Fatalf("move of 1 into %d: expected a cycle, got %v", target, err)
+		}
+	}
+	// the walk stops at the page holding the target, 3 is found below 2
+	if lists := web.listedGroups(); lists != 3 {
+		t.Fatalf("listed groups %d times, expected 3", lists)
+	}
+	if web.groups[0].Parent != 0 {
+		t.Fatal("a folder was moved into its own subtree")
+	}
+
+	if err := s.MoveFolder(ctx, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+	if web.groups[1].Parent != 4 {
+		t.Fatalf("folder 2 is under %d, expected 4", web.groups[1].Parent)
+	}
+
+	// 1 is not above 4 anymore
+	if err := s.MoveFolder(ctx, 4, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MoveFolder(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MoveFolder(ctx, 0, 1); err == nil {
+		t.Fatal("the root was moved")
+	}
+
+	if err := s.MoveAsset(ctx, "bafy", 3); err != nil || len(web.moved) != 1 {
+		t.Fatalf("asset not moved: %v", err)
+	}
+	if err := s.MoveAsset(ctx, "", 3); err == nil {
+		t.Fatal("an asset without cid was moved")
+	}
+}
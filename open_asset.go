@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// AssetReader reads an asset at any offset
+type AssetReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// assetReader reads the plain content of an asset through a section of its size
+type assetReader struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// OpenAsset opens the asset for random access, only the chunks that are read are downloaded.
+// Encrypted assets are decrypted frame by frame, they cannot be opened without a KeyProvider.
+func (s *storage) OpenAsset(ctx context.Context, assetCID string) (AssetReader, error) {
+	res, err := s.GetURL(ctx, assetCID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDecryptable(assetCID, res); err != nil {
+		return nil, err
+	}
+
+	r := s.newRange()
+	f, err := r.Open(ctx, res.Copy2RangeFileReq())
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := s.decryptDownload(ctx, res.Encrypted, f)
+	if err != nil {
+		return nil, err
+	}
+
+	// plain content is the file itself
+	if rc == io.ReadCloser(f) {
+		return f, nil
+	}
+
+	sized, ok := rc.(interface {
+		io.ReaderAt
+		Size() int64
+	})
+	if !ok {
+		rc.Close()
+		return nil, errors.New("decrypted asset does not support random access")
+	}
+
+	return &assetReader{SectionReader: io.NewSectionReader(sized, 0, sized.Size()), Closer: rc}, nil
+}
@@ -0,0 +1,215 @@
+package byterange
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// defaultMemoryBudget bounds the bytes buffered by WithMemoryBuffer when no budget is set
+const defaultMemoryBudget = 32 << 20
+
+// bufferBudget bounds the bytes fetched ahead of the consumer, from the moment their range is assigned to a worker
+// until they are written by WriteFile or read from the reader of GetFile. A nil budget is unlimited.
+type bufferBudget struct {
+	mu    sync.Mutex
+	limit int64
+	// reserved are the ranges assigned and not consumed yet
+	reserved []Segment
+	size     int64
+	// changed is signaled when bytes are released
+	changed chan struct{}
+}
+
+func newBufferBudget(limit int64) *bufferBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &bufferBudget{limit: limit, changed: make(chan struct{}, 1)}
+}
+
+// available returns the number of bytes that can be reserved
+func (b *bufferBudget) available() int64 {
+	if b == nil {
+		return math.MaxInt64
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit - b.size
+}
+
+// reserve accounts the range seg until it is released
+func (b *bufferBudget) reserve(seg Segment) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserved = append(b.reserved, seg)
+	b.size += seg.End - seg.Start
+}
+
+// release releases the range seg
+func (b *bufferBudget) release(seg Segment) {
+	b.releaseIf(func(s Segment) bool { return s == seg })
+}
+
+// consumedTo releases the ranges before offset, the consumer read everything before it
+func (b *bufferBudget) consumedTo(offset int64) {
+	b.releaseIf(func(s Segment) bool { return s.End <= offset })
+}
+
+func (b *bufferBudget) releaseIf(match func(Segment) bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	kept := b.reserved[:0]
+	var released bool
+	for _, s := range b.reserved {
+		if match(s) {
+			b.size -= s.End - s.Start
+			released = true
+			continue
+		}
+		kept = append(kept, s)
+	}
+	b.reserved = kept
+	b.mu.Unlock()
+
+	if released {
+		select {
+		case b.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// released returns a channel signaled when bytes are released, nil for an unlimited budget
+func (b *bufferBudget) released() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.changed
+}
+
+// budgetReader releases the budget of the bytes read from a sequential reader
+type budgetReader struct {
+	io.ReadCloser
+	budget *bufferBudget
+	offset int64
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.offset += int64(n)
+		r.budget.consumedTo(r.offset)
+	}
+	return n, err
+}
+
+// memoryPipe delivers the chunks written at any offset in order, without a temporary file.
+// Chunks are kept until they are read, the dispatcher bounds them with a bufferBudget.
+type memoryPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64
+	// chunks are the chunks not read yet, by offset
+	chunks  map[int64][]byte
+	offset  int64
+	written int64
+	// err is set when the writer is closed, io.EOF once every chunk is written
+	err    error
+	closed bool
+}
+
+func newMemoryPipe(size int64) *memoryPipe {
+	p := &memoryPipe{size: size, chunks: make(map[int64][]byte)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// WriteAt keeps the chunk until it is read, b must not be modified afterwards
+func (p *memoryPipe) WriteAt(b []byte, off int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if off < p.offset {
+		return 0, fmt.Errorf("write at %d behind the reader at %d", off, p.offset)
+	}
+
+	p.chunks[off] = b
+	p.written += int64(len(b))
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+// Read reads the chunks in order, it blocks until the next one is written
+func (p *memoryPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if p.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if p.offset >= p.size {
+			return 0, io.EOF
+		}
+
+		if chunk, ok := p.chunks[p.offset]; ok {
+			n := copy(b, chunk)
+			delete(p.chunks, p.offset)
+			if n < len(chunk) {
+				p.chunks[p.offset+int64(n)] = chunk[n:]
+			}
+			p.offset += int64(n)
+			return n, nil
+		}
+
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.cond.Wait()
+	}
+}
+
+// Close closes the reader, the chunks are dropped and the next writes fail
+func (p *memoryPipe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.chunks = nil
+	p.cond.Broadcast()
+	return nil
+}
+
+// CloseWithError closes the writer, the reader fails with err once it reads past the chunks written
+func (p *memoryPipe) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err
+	p.cond.Broadcast()
+	return nil
+}
+
+// GetWrittenBytes returns the bytes written
+func (p *memoryPipe) GetWrittenBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.written
+}
@@ -12,7 +12,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/eikenb/pipeat"
 	"github.com/pkg/errors"
 	"github.com/utopiosphe/titan-storage-sdk/client"
 )
@@ -20,12 +19,29 @@ import (
 type dispatcher struct {
 	fileSize  int64
 	rangeSize int64
+	// completed are the segments already written, they are not fetched again
+	completed []Segment
 	todos     JobQueue
 	workers   chan worker
 	resp      chan response
-	writer    *pipeat.PipeWriterAt
-	reader    *pipeat.PipeReaderAt
-	backoff   *backoff
+	writer    io.WriterAt
+	// written is called after every segment written, it may be nil
+	written func(Segment) error
+	// closeWriter is called with the error of the download when the dispatcher stops writing, it may be nil
+	closeWriter func(error) error
+	// abort stops the download with the error of a write or of the exhausted retries
+	abort   context.CancelCauseFunc
+	backoff *backoff
+	// jobRetries is the number of times a range is fetched again before the download fails
+	jobRetries int
+	// downloadRetries is the number of failed fetches of the whole download before it fails
+	downloadRetries int
+	// budget bounds the bytes fetched ahead of the consumer, nil is unlimited
+	budget *bufferBudget
+	// stats collects the progress of the download and the contributions of the workers
+	stats *downloadStats
+	// exited is closed once the writer goroutine returned, nothing is written after it
+	exited chan struct{}
 	// workloads *workloadIDMap
 }
 
@@ -54,6 +70,14 @@ type worker struct {
 	// workloadID string
 }
 
+// name identifies the worker in errors, its node ID or its endpoint
+func (w worker) name() string {
+	if w.nodeID != "" {
+		return w.nodeID
+	}
+	return w.e
+}
+
 type response struct {
 	offset int64
 	data   []byte
@@ -88,24 +112,18 @@ func (b *backoff) next(attempt int) time.Duration {
 	return delay
 }
 
-func (d *dispatcher) generateJobs() {
-	count := int64(math.Ceil(float64(d.fileSize) / float64(d.rangeSize)))
-	for i := int64(0); i < count; i++ {
-		start := i * d.rangeSize
-		end := (i + 1) * d.rangeSize
-
-		if end > d.fileSize {
-			end = d.fileSize
-		}
-
-		newJob := &job{
-			index: int(i),
-			start: start,
-			end:   end,
-		}
+// remaining is the number of bytes to fetch
+func (d *dispatcher) remaining() int64 {
+	return remaining(d.completed, d.fileSize)
+}
 
-		d.todos.Push(newJob)
+// remaining is the number of bytes of a file of fileSize missing from completed
+func remaining(completed []Segment, fileSize int64) int64 {
+	var size int64
+	for _, seg := range missingSegments(completed, fileSize) {
+		size += seg.End - seg.Start
 	}
+	return size
 }
 
 type debugRunningNode struct {
@@ -115,89 +133,41 @@ type debugRunningNode struct {
 	cost    time.Duration
 }
 
+// run fetches the missing segments across the workers and writes them, sig is signaled once every byte is written
 func (d *dispatcher) run(ctx context.Context, sig chan struct{}) {
-	d.generateJobs()
 	d.writeData(ctx, sig)
-
-	var (
-		counter  int64
-		finished = make(chan int64, 1)
-	)
-
-	go func() {
-		for {
-			select {
-			case w := <-d.workers:
-				go func() {
-					j, ok := d.todos.Pop()
-					if !ok {
-						d.workers <- w
-						return
-					}
-
-					data, err := d.fetch(ctx, w, j)
-					if err != nil {
-						if j.retry > 0 {
-							log.Printf("[pull data failed] (retries: %d, from: %d, to: %d): %v", j.retry, j.start, j.end, err)
-							<-time.After(d.backoff.next(j.retry))
-						}
-
-						j.retry++
-						d.todos.PushFront(j)
-						d.workers <- w
-						return
-					}
-
-					dataLen := j.end - j.start
-
-					if int64(len(data)) < dataLen {
-						log.Printf("unexpected data size, want %d got %d", dataLen, len(data))
-						d.todos.PushFront(j)
-						d.workers <- w
-						return
-					}
-
-					d.workers <- w
-					// log.Printf("fetched data from %d to %d, currnet count: %d", j.start, j.end, counter)
-					d.resp <- response{
-						data:   data[:dataLen],
-						offset: j.start,
-					}
-					finished <- dataLen
-				}()
-			case size := <-finished:
-				log.Printf("counter: %d, received: %d, file-size: %d", counter, size, d.fileSize)
-				counter += size
-				if counter >= d.fileSize {
-					return
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+	go newScheduler(d).run(ctx)
 }
 
 func (d *dispatcher) writeData(ctx context.Context, sig chan struct{}) {
+	d.exited = make(chan struct{})
 	go func() {
-		defer d.finally()
+		defer close(d.exited)
 
-		var count int64
+		var (
+			count     int64
+			remaining = d.remaining()
+		)
 		for {
 			select {
 			case r := <-d.resp:
-				_, err := d.writer.WriteAt(r.data, r.offset)
-				if err != nil {
-					log.Printf("write data failed: %v", err)
-					continue
+				if err := d.write(r); err != nil {
+					d.abort(err)
+					d.stats.finish(err)
+					d.finally(err)
+					return
 				}
 				// log.Printf("write data success: %d, length: %d", r.offset, len(r.data))
 				count += int64(len(r.data))
-				if count >= d.fileSize {
+				if count >= remaining {
+					d.stats.finish(nil)
 					sig <- struct{}{}
+					d.finally(nil)
 					return
 				}
 			case <-ctx.Done():
+				d.stats.finish(context.Cause(ctx))
+				d.finally(context.Cause(ctx))
 				return
 			}
 		}
@@ -205,6 +175,19 @@ func (d *dispatcher) writeData(ctx context.Context, sig chan struct{}) {
 	}()
 }
 
+// write writes the data of r and records its segment
+func (d *dispatcher) write(r response) error {
+	if _, err := d.writer.WriteAt(r.data, r.offset); err != nil {
+		return err
+	}
+	d.stats.wrote(int64(len(r.data)))
+
+	if d.written == nil {
+		return nil
+	}
+	return d.written(Segment{Start: r.offset, End: r.offset + int64(len(r.data))})
+}
+
 // type timeCal struct {
 // 	t    time.Time
 // 	done chan struct{}
@@ -223,7 +206,8 @@ func (d *dispatcher) writeData(ctx context.Context, sig chan struct{}) {
 // 	}
 // }
 
-func (d *dispatcher) fetch(ctx context.Context, w worker, j *job) ([]byte, error) {
+// fetch downloads the range of j from the worker
+func fetch(ctx context.Context, w worker, j *job) ([]byte, error) {
 	// startTime := time.Now()
 
 	var buf bytes.Buffer
@@ -302,8 +286,12 @@ func (c *countableReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
-func (d *dispatcher) finally() {
-	if err := d.writer.Close(); err != nil {
+// finally closes the writer with err, nil once every byte is written
+func (d *dispatcher) finally(err error) {
+	if d.closeWriter == nil {
+		return
+	}
+	if err := d.closeWriter(err); err != nil {
 		log.Printf("close write failed: %v", err)
 	}
 }
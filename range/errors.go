@@ -0,0 +1,58 @@
+package byterange
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxReportedRanges bounds the ranges listed by the message of a RetryError
+const maxReportedRanges = 10
+
+// RangeFailure is a failed fetch of a range from a node
+type RangeFailure struct {
+	Start int64
+	End   int64
+	// Node is the ID of the node, or its URL if it has no ID
+	Node string
+	Err  error
+}
+
+// RetryError is returned by a download whose retries are exhausted, with every fetch that failed
+type RetryError struct {
+	// Reason tells which retry budget is exhausted
+	Reason   string
+	Failures []RangeFailure
+}
+
+func (e *RetryError) Error() string {
+	var (
+		order   []Segment
+		byRange = make(map[Segment][]string)
+	)
+	for _, f := range e.Failures {
+		seg := Segment{Start: f.Start, End: f.End}
+		if _, ok := byRange[seg]; !ok {
+			order = append(order, seg)
+		}
+		byRange[seg] = append(byRange[seg], fmt.Sprintf("%s (%v)", f.Node, f.Err))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "download failed, %s", e.Reason)
+	for i, seg := range order {
+		if i == maxReportedRanges {
+			fmt.Fprintf(&b, "; and %d more ranges", len(order)-i)
+			break
+		}
+		fmt.Fprintf(&b, "; range %d-%d failed on %s", seg.Start, seg.End, strings.Join(byRange[seg], ", "))
+	}
+	return b.String()
+}
+
+// Unwrap returns the error of the last failed fetch
+func (e *RetryError) Unwrap() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e.Failures[len(e.Failures)-1].Err
+}
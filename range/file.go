@@ -0,0 +1,324 @@
+package byterange
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+const (
+	// defaultCacheChunks is the number of chunks kept by a File
+	defaultCacheChunks = 16
+	// defaultReadAhead is the number of chunks a File fetches ahead of the last chunk read
+	defaultReadAhead = 2
+	// maxChunkAttempts is the number of times a chunk is requested before a read fails
+	maxChunkAttempts = 3
+)
+
+// File reads a remote file at any offset, the chunks are fetched on demand with range requests across the workers.
+// The chunks following the last one read are fetched ahead, and the recent chunks are kept in a LRU cache.
+// File is safe for concurrent use, but concurrent Read and Seek share the same offset.
+type File struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workers   chan worker
+	size      int64
+	chunkSize int64
+	readAhead int64
+	backoff   *backoff
+
+	mu       sync.Mutex
+	cache    *chunkCache
+	inflight map[int64]*chunkFetch
+	offset   int64
+}
+
+// chunkFetch is a chunk being fetched, done is closed once data or err is set
+type chunkFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Open opens the remote file for random access, nothing is fetched but the file size until it is read.
+// The file must be closed to release its workers.
+func (r *Range) Open(ctx context.Context, resources *client.RangeGetFileReq) (*File, error) {
+	workerChan, err := r.makeWorkerChan(ctx, resources)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.openFile(ctx, workerChan)
+}
+
+func (r *Range) openFile(ctx context.Context, workerChan chan worker) (*File, error) {
+	fileSize, err := r.getFileSize(ctx, workerChan)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &File{
+		ctx:       ctx,
+		cancel:    cancel,
+		workers:   workerChan,
+		size:      fileSize,
+		chunkSize: r.size,
+		readAhead: defaultReadAhead,
+		backoff: &backoff{
+			minDelay: minBackoffDelay,
+			maxDelay: maxBackoffDelay,
+		},
+		cache:    newChunkCache(defaultCacheChunks),
+		inflight: make(map[int64]*chunkFetch),
+	}, nil
+}
+
+// Size returns the size of the file
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.ctx.Err() != nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) && off+int64(n) < f.size {
+		pos := off + int64(n)
+		index := pos / f.chunkSize
+
+		data, err := f.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		f.prefetch(index)
+
+		n += copy(p[n:], data[pos-index*f.chunkSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+
+	n, err := f.ReadAt(p, offset)
+
+	f.mu.Lock()
+	f.offset = offset + int64(n)
+	f.mu.Unlock()
+
+	if n > 0 && errors.Is(err, io.EOF) {
+		return n, nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+// Close stops the fetches in progress and drops the cache
+func (f *File) Close() error {
+	f.cancel()
+
+	f.mu.Lock()
+	f.cache = newChunkCache(defaultCacheChunks)
+	f.mu.Unlock()
+	return nil
+}
+
+// chunk returns the chunk at index from the cache, or waits for its fetch
+func (f *File) chunk(index int64) ([]byte, error) {
+	f.mu.Lock()
+	if data, ok := f.cache.get(index); ok {
+		f.mu.Unlock()
+		return data, nil
+	}
+	fetch := f.startFetch(index)
+	f.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.data, fetch.err
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	}
+}
+
+// prefetch fetches the chunks following index that are not cached yet
+func (f *File) prefetch(index int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := index + 1; i <= index+f.readAhead && i*f.chunkSize < f.size; i++ {
+		if _, ok := f.cache.peek(i); ok {
+			continue
+		}
+		f.startFetch(i)
+	}
+}
+
+// startFetch returns the fetch of the chunk at index, starting it if it is not in progress, f.mu must be held
+func (f *File) startFetch(index int64) *chunkFetch {
+	if fetch, ok := f.inflight[index]; ok {
+		return fetch
+	}
+
+	fetch := &chunkFetch{done: make(chan struct{})}
+	f.inflight[index] = fetch
+
+	go func() {
+		data, err := f.download(index)
+
+		f.mu.Lock()
+		delete(f.inflight, index)
+		if err == nil {
+			f.cache.add(index, data)
+		}
+		f.mu.Unlock()
+
+		fetch.data, fetch.err = data, err
+		close(fetch.done)
+	}()
+
+	return fetch
+}
+
+// download requests the chunk at index from the first free worker, a failed request is retried on the next one
+func (f *File) download(index int64) ([]byte, error) {
+	start := index * f.chunkSize
+	end := start + f.chunkSize
+	if end > f.size {
+		end = f.size
+	}
+	j := &job{index: int(index), start: start, end: end}
+
+	var err error
+	for j.retry = 0; j.retry < maxChunkAttempts; j.retry++ {
+		if j.retry > 0 {
+			select {
+			case <-time.After(f.backoff.next(j.retry)):
+			case <-f.ctx.Done():
+				return nil, f.ctx.Err()
+			}
+		}
+
+		var w worker
+		select {
+		case w = <-f.workers:
+		case <-f.ctx.Done():
+			return nil, f.ctx.Err()
+		}
+
+		var data []byte
+		data, err = fetch(f.ctx, w, j)
+		f.workers <- w
+
+		if err == nil && int64(len(data)) < end-start {
+			err = fmt.Errorf("unexpected data size, want %d got %d", end-start, len(data))
+		}
+		if err == nil {
+			return data[:end-start], nil
+		}
+	}
+
+	return nil, fmt.Errorf("fetch chunk %d-%d: %w", start, end, err)
+}
+
+// chunkCache keeps the most recently used chunks by index
+type chunkCache struct {
+	capacity int
+	order    *list.List
+	items    map[int64]*list.Element
+}
+
+type cachedChunk struct {
+	index int64
+	data  []byte
+}
+
+func newChunkCache(capacity int) *chunkCache {
+	return &chunkCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[int64]*list.Element),
+	}
+}
+
+// get returns the chunk at index and marks it as the most recently used
+func (c *chunkCache) get(index int64) ([]byte, bool) {
+	e, ok := c.items[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedChunk).data, true
+}
+
+// peek returns the chunk at index without changing the order
+func (c *chunkCache) peek(index int64) ([]byte, bool) {
+	e, ok := c.items[index]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*cachedChunk).data, true
+}
+
+// add adds the chunk at index, evicting the least recently used chunk if the cache is full
+func (c *chunkCache) add(index int64, data []byte) {
+	if e, ok := c.items[index]; ok {
+		e.Value.(*cachedChunk).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[index] = c.order.PushFront(&cachedChunk{index: index, data: data})
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedChunk).index)
+	}
+}
@@ -2,7 +2,6 @@ package byterange
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -12,10 +11,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eikenb/pipeat"
-	"github.com/quic-go/quic-go/http3"
 	"github.com/utopiosphe/titan-storage-sdk/client"
 	"github.com/utopiosphe/titan-storage-sdk/request"
 )
@@ -23,39 +22,111 @@ import (
 const (
 	minBackoffDelay = 100 * time.Millisecond
 	maxBackoffDelay = 3 * time.Second
+
+	// defaultJobRetries is the number of times a range is fetched again before the download fails
+	defaultJobRetries = 5
+	// defaultDownloadRetries is the number of failed fetches of a download before it fails
+	defaultDownloadRetries = 30
 )
 
 // var log = logging.Logger("range")
 
 type Range struct {
-	size       int64
-	timeout    time.Duration
-	dispatcher *dispatcher
+	size            int64
+	timeout         time.Duration
+	jobRetries      int
+	downloadRetries int
+	bufferBudget    int64
+	memoryBuffer    bool
+	transport       *Transport
+	middlewares     []client.Middleware
+	// dispatcher is the dispatcher of the last download
+	dispatcher atomic.Pointer[dispatcher]
+}
+
+// Option customizes a Range
+type Option func(*Range)
+
+// WithRetryBudget sets the number of times a range is fetched again, and the number of failed fetches of a whole download,
+// before the download fails with a *RetryError. Values below 0 are ignored.
+func WithRetryBudget(jobRetries, downloadRetries int) Option {
+	return func(r *Range) {
+		if jobRetries >= 0 {
+			r.jobRetries = jobRetries
+		}
+		if downloadRetries >= 0 {
+			r.downloadRetries = downloadRetries
+		}
+	}
+}
+
+// WithBufferBudget bounds the bytes fetched ahead of the consumer, in flight or buffered, to budget.
+// The workers pause when it is reached, until WriteFile writes the ranges or the reader of GetFile reads them.
+// The pipe of GetFile still spools the whole file to a temporary file, use WithMemoryBuffer to avoid it.
+func WithBufferBudget(budget int64) Option {
+	return func(r *Range) {
+		r.bufferBudget = budget
+	}
+}
+
+// WithMemoryBuffer makes GetFile reorder the ranges in memory instead of a temporary file,
+// the ranges are dropped once read. The budget defaults to 32 MiB without WithBufferBudget.
+func WithMemoryBuffer() Option {
+	return func(r *Range) {
+		r.memoryBuffer = true
+	}
+}
+
+// WithTransport makes the workers connect to the nodes through t instead of DefaultTransport
+func WithTransport(t *Transport) Option {
+	return func(r *Range) {
+		r.transport = t
+	}
+}
+
+// WithMiddleware wraps the transport of the workers with middlewares, the first one sees the requests first
+func WithMiddleware(middlewares ...client.Middleware) Option {
+	return func(r *Range) {
+		r.middlewares = append(r.middlewares, middlewares...)
+	}
 }
 
-func New(size int64, seconds int) *Range {
+func New(size int64, seconds int, options ...Option) *Range {
 	if seconds < 1 {
 		seconds = 5
 	}
 
-	return &Range{
-		size:    size,
-		timeout: time.Duration(seconds) * time.Second,
+	r := &Range{
+		size:            size,
+		timeout:         time.Duration(seconds) * time.Second,
+		jobRetries:      defaultJobRetries,
+		downloadRetries: defaultDownloadRetries,
 	}
+	for _, opt := range options {
+		opt(r)
+	}
+	if r.transport == nil {
+		r.transport = DefaultTransport()
+	}
+	return r
 }
 
 type Progress struct {
 	Written func() int64
 	Total   int64
 	Done    chan struct{}
+	// Stats returns the rate, the ETA and the contributions of the nodes of the download
+	Stats func() Stats
 }
 
 type ProgressFunc func() Progress
 
 var zeroProgressFunc = func() Progress {
-	return Progress{nil, 0, nil}
+	return Progress{nil, 0, nil, nil}
 }
 
+// GetFile downloads the file into a pipe, chunks are fetched in parallel and read in order.
+// If the download fails, once its retries are exhausted for instance, the reader fails with its error.
 func (r *Range) GetFile(ctx context.Context, resources *client.RangeGetFileReq) (io.ReadCloser, ProgressFunc, error) {
 
 	workerChan, err := r.makeWorkerChan(ctx, resources)
@@ -63,33 +134,66 @@ func (r *Range) GetFile(ctx context.Context, resources *client.RangeGetFileReq)
 		return nil, zeroProgressFunc, err
 	}
 
+	return r.getFile(ctx, workerChan)
+}
+
+func (r *Range) getFile(ctx context.Context, workerChan chan worker) (io.ReadCloser, ProgressFunc, error) {
 	fileSize, err := r.getFileSize(ctx, workerChan)
 	if err != nil {
 		return nil, zeroProgressFunc, err
 	}
 
 	var (
-		reader *pipeat.PipeReaderAt
-		writer *pipeat.PipeWriterAt
+		reader io.ReadCloser
+		writer pipeWriter
+		budget = newBufferBudget(r.bufferBudget)
 	)
 
-	PipeDir := os.Getenv("TITAN_PIPE_DIR")
-	if PipeDir == "" {
-		reader, writer, err = pipeat.Pipe()
+	if r.memoryBuffer {
+		if budget == nil {
+			budget = newBufferBudget(defaultMemoryBudget)
+		}
+		pipe := newMemoryPipe(fileSize)
+		reader, writer = pipe, pipe
 	} else {
-		reader, writer, err = pipeat.PipeInDir(PipeDir)
+		var (
+			pr *pipeat.PipeReaderAt
+			pw *pipeat.PipeWriterAt
+		)
+
+		PipeDir := os.Getenv("TITAN_PIPE_DIR")
+		if PipeDir == "" {
+			pr, pw, err = pipeat.Pipe()
+		} else {
+			pr, pw, err = pipeat.PipeInDir(PipeDir)
+		}
+
+		if err != nil {
+			return nil, zeroProgressFunc, err
+		}
+		reader, writer = pr, pw
 	}
 
-	if err != nil {
-		return nil, zeroProgressFunc, err
+	if budget != nil {
+		reader = &budgetReader{ReadCloser: reader, budget: budget}
 	}
 
+	ctx, cancel := context.WithCancelCause(ctx)
+
 	d := &dispatcher{
 		fileSize:  fileSize,
 		rangeSize: r.size,
-		reader:    reader,
 		writer:    writer,
-		workers:   workerChan,
+		closeWriter: func(err error) error {
+			cancel(err)
+			return writer.CloseWithError(err)
+		},
+		abort:           cancel,
+		jobRetries:      r.jobRetries,
+		downloadRetries: r.downloadRetries,
+		budget:          budget,
+		stats:           newDownloadStats(fileSize, 0),
+		workers:         workerChan,
 		// workloads: newWorkloadIDMapFromMapPointer(resources.Workload),
 		resp: make(chan response, len(workerChan)),
 		backoff: &backoff{
@@ -98,28 +202,134 @@ func (r *Range) GetFile(ctx context.Context, resources *client.RangeGetFileReq)
 		},
 	}
 	retProgress := Progress{
-		Written: d.writer.GetWrittenBytes,
+		Written: writer.GetWrittenBytes,
 		Total:   d.fileSize,
 		Done:    make(chan struct{}, 1),
+		Stats:   d.stats.snapshot,
 	}
+	r.dispatcher.Store(d)
 
 	d.run(ctx, retProgress.Done)
 
 	return reader, func() Progress { return retProgress }, nil
 }
 
+// pipeWriter is the writer side of the pipe of GetFile
+type pipeWriter interface {
+	io.WriterAt
+	CloseWithError(err error) error
+	GetWrittenBytes() int64
+}
+
+// GetProgress returns the fraction of the file written by the last download
 func (r *Range) GetProgress() float64 {
-	if r.dispatcher == nil || r.size == 0 {
+	st := r.Stats()
+	if st.Total == 0 {
 		return 0
 	}
-	return float64(r.dispatcher.writer.GetWrittenBytes()) / float64(r.size)
+	return float64(st.Done) / float64(st.Total)
 }
 
+// GetWrittenBytes returns the number of bytes written by the last download
 func (r *Range) GetWrittenBytes() int64 {
-	if r.dispatcher == nil {
-		return 0
+	return r.Stats().Done
+}
+
+// Stats returns the stats of the last download, zero before it starts
+func (r *Range) Stats() Stats {
+	d := r.dispatcher.Load()
+	if d == nil {
+		return Stats{}
+	}
+	return d.stats.snapshot()
+}
+
+// ResumeState records the segments of a file written by WriteFile, so an interrupted download only fetches what is missing
+type ResumeState interface {
+	// Completed returns the segments already written for a file of size, a state of another size returns nil
+	Completed(size int64) ([]Segment, error)
+	// Written records that seg has been written, it is called from a single goroutine
+	Written(seg Segment) error
+}
+
+// WriteFile downloads the file into w with WriteAt, chunks are fetched in parallel and written as soon as they arrive.
+// The segments completed in state are skipped, and every segment written is recorded into it, state may be nil.
+// It returns the file size once every byte is written.
+func (r *Range) WriteFile(ctx context.Context, resources *client.RangeGetFileReq, w io.WriterAt, state ResumeState) (int64, error) {
+	workerChan, err := r.makeWorkerChan(ctx, resources)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.writeFile(ctx, workerChan, w, state)
+}
+
+func (r *Range) writeFile(ctx context.Context, workerChan chan worker, w io.WriterAt, state ResumeState) (int64, error) {
+	fileSize, err := r.getFileSize(ctx, workerChan)
+	if err != nil {
+		return 0, err
+	}
+
+	var completed []Segment
+	if state != nil {
+		if completed, err = state.Completed(fileSize); err != nil {
+			return 0, err
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	d := &dispatcher{
+		fileSize:        fileSize,
+		rangeSize:       r.size,
+		completed:       completed,
+		writer:          w,
+		abort:           cancel,
+		jobRetries:      r.jobRetries,
+		downloadRetries: r.downloadRetries,
+		budget:          newBufferBudget(r.bufferBudget),
+		stats:           newDownloadStats(fileSize, fileSize-remaining(completed, fileSize)),
+		workers:         workerChan,
+		resp:            make(chan response, len(workerChan)),
+		backoff: &backoff{
+			minDelay: minBackoffDelay,
+			maxDelay: maxBackoffDelay,
+		},
+	}
+	if state != nil {
+		d.written = state.Written
+	}
+	if d.budget != nil {
+		// the ranges are consumed once written
+		d.written = func(seg Segment) error {
+			d.budget.release(seg)
+			if state == nil {
+				return nil
+			}
+			return state.Written(seg)
+		}
+	}
+	r.dispatcher.Store(d)
+
+	if d.remaining() <= 0 {
+		d.stats.finish(nil)
+		return fileSize, nil
+	}
+
+	done := make(chan struct{}, 1)
+	d.run(ctx, done)
+
+	// the writer may be in the middle of a WriteAt or of recording a segment into state,
+	// the caller closes w and saves state once it returns
+	select {
+	case <-done:
+		<-d.exited
+		return fileSize, nil
+	case <-ctx.Done():
+		<-d.exited
+		return 0, context.Cause(ctx)
 	}
-	return r.dispatcher.writer.GetWrittenBytes()
 }
 
 func (r *Range) getFileSize(ctx context.Context, workerChan chan worker) (int64, error) {
@@ -128,31 +338,33 @@ func (r *Range) getFileSize(ctx context.Context, workerChan chan worker) (int64,
 		size  int64 = 1
 	)
 
-	for {
+	// every worker is asked once
+	for attempt := 0; attempt < cap(workerChan); attempt++ {
 		select {
 		case w := <-workerChan:
 			req, err := http.NewRequest("GET", w.e, nil)
 			if err != nil {
+				workerChan <- w
 				log.Printf("new request failed: %v", err)
 				continue
 			}
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+size))
 
-			resp, err := w.c.Do(req)
+			resp, err := w.c.Do(req.WithContext(ctx))
+			// the worker is still needed to fetch the file
+			workerChan <- w
 			if err != nil {
 				log.Printf("fetch failed: %v", err)
 				continue
 			}
-			defer func() {
-				if resp != nil && resp.Body != nil {
-					resp.Body.Close()
-				}
-			}()
+			resp.Body.Close()
+
 			v := resp.Header.Get("Content-Range")
 			if v != "" {
 				subs := strings.Split(v, "/")
 				if len(subs) != 2 {
 					log.Printf("invalid content range: %s", v)
+					continue
 				}
 				return strconv.ParseInt(subs[1], 10, 64)
 			}
@@ -161,11 +373,21 @@ func (r *Range) getFileSize(ctx context.Context, workerChan chan worker) (int64,
 			return 0, ctx.Err()
 		}
 	}
+
+	return 0, fmt.Errorf("no worker returned the file size")
 }
 
 func (r *Range) makeWorkerChan(ctx context.Context, res *client.RangeGetFileReq) (chan worker, error) {
 	workerChan := make(chan worker, len(res.Urls))
 
+	// the version probe leaves time to fall back from HTTP/3
+	probeTimeout := time.Second
+	if r.transport.cfg.Protocol == ProtocolAuto {
+		probeTimeout += h3HandshakeTimeout
+	}
+
+	transport := client.Chain(r.transport, r.middlewares...)
+
 	var wg sync.WaitGroup
 	wg.Add(len(res.Urls))
 
@@ -175,10 +397,8 @@ func (r *Range) makeWorkerChan(ctx context.Context, res *client.RangeGetFileReq)
 
 			var tk *client.BodyToken = u.Token
 			client := &http.Client{
-				Transport: &http3.RoundTripper{TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				}},
-				Timeout: 1 * time.Second,
+				Transport: transport,
+				Timeout:   probeTimeout,
 			}
 
 			uu, err := url.Parse(u.Url)
@@ -186,6 +406,7 @@ func (r *Range) makeWorkerChan(ctx context.Context, res *client.RangeGetFileReq)
 				log.Printf("parse url failed: %v", err)
 				return
 			}
+			r.transport.addNode(uu.Host, u.NodeID)
 
 			req := request.Request{
 				Jsonrpc: "2.0",
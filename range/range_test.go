@@ -0,0 +1,620 @@
+package byterange
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memoryState struct {
+	completed []Segment
+	written   []Segment
+}
+
+func (m *memoryState) Completed(size int64) ([]Segment, error) {
+	return m.completed, nil
+}
+
+func (m *memoryState) Written(seg Segment) error {
+	m.written = append(m.written, seg)
+	return nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// newRangeServer serves content with range requests and records the offset of every range requested
+func newRangeServer(t *testing.T, content []byte) (*httptest.Server, func() []string) {
+	var (
+		mu     sync.Mutex
+		ranges []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func newWorkers(srv *httptest.Server, n int) chan worker {
+	workers := make(chan worker, n)
+	for i := 0; i < n; i++ {
+		workers <- worker{c: srv.Client(), e: srv.URL}
+	}
+	return workers
+}
+
+func TestWriteFileResume(t *testing.T) {
+	const rangeSize = 64 << 10
+
+	content := make([]byte, 10*rangeSize+123)
+	rand.Read(content)
+	srv, requested := newRangeServer(t, content)
+
+	dst := filepath.Join(t.TempDir(), "file")
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the first 3 ranges and the 6th were written by a previous download
+	done := []Segment{{Start: 0, End: 3 * rangeSize}, {Start: 5 * rangeSize, End: 6 * rangeSize}}
+	for _, seg := range done {
+		if _, err := f.WriteAt(content[seg.Start:seg.End], seg.Start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := &memoryState{completed: done}
+	r := New(rangeSize, 3)
+
+	size, err := r.writeFile(context.Background(), newWorkers(srv, 3), f, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(content)) {
+		t.Fatalf("got size %d, expected %d", size, len(content))
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+
+	if done := r.GetWrittenBytes(); done != int64(len(content)) || r.GetProgress() != 1 {
+		t.Fatalf("progress %d, %f after the resumed download", done, r.GetProgress())
+	}
+
+	expect := []Segment{{Start: 0, End: int64(len(content))}}
+	if merged := MergeSegments(append(state.written, done...)); fmt.Sprint(merged) != fmt.Sprint(expect) {
+		t.Fatalf("recorded segments %v, expected %v", merged, expect)
+	}
+
+	for _, rng := range requested() {
+		var start, end int64
+		fmt.Sscanf(rng, "bytes=%d-%d", &start, &end)
+		// the first request reads the file size
+		if end-start <= 1 {
+			continue
+		}
+		for _, seg := range done {
+			if start >= seg.Start && start < seg.End {
+				t.Fatalf("completed range %s was fetched again", rng)
+			}
+		}
+	}
+}
+
+func TestWriteFileAbortsOnWriteError(t *testing.T) {
+	content := make([]byte, 1<<20)
+	srv, _ := newRangeServer(t, content)
+
+	r := New(64<<10, 3)
+	_, err := r.writeFile(context.Background(), newWorkers(srv, 2), failingWriter{}, nil)
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+}
+
+// slowWriter cancels the download on its first write, and records the writes made after it is closed
+type slowWriter struct {
+	cancel     context.CancelFunc
+	closed     bool
+	lateWrites int
+}
+
+func (w *slowWriter) WriteAt(p []byte, off int64) (int, error) {
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	time.Sleep(50 * time.Millisecond)
+	if w.closed {
+		w.lateWrites++
+	}
+	return len(p), nil
+}
+
+func TestWriteFileWaitsForWriterOnCancel(t *testing.T) {
+	content := make([]byte, 1<<20)
+	srv, _ := newRangeServer(t, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &slowWriter{cancel: cancel}
+	state := &memoryState{}
+	r := New(64<<10, 3)
+
+	if _, err := r.writeFile(ctx, newWorkers(srv, 3), w, state); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v", err)
+	}
+
+	// the caller closes the file and saves the state once writeFile returns
+	w.closed = true
+	if len(state.written) == 0 {
+		t.Fatal("the write in progress was not recorded")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if w.lateWrites != 0 {
+		t.Fatalf("%d writes after writeFile returned", w.lateWrites)
+	}
+}
+
+func TestMergeSegments(t *testing.T) {
+	got := MergeSegments([]Segment{{5, 8}, {0, 2}, {2, 3}, {7, 10}, {12, 12}, {11, 13}})
+	expect := []Segment{{0, 3}, {5, 10}, {11, 13}}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("got %v, expected %v", got, expect)
+	}
+
+	missing := missingSegments(got, 12)
+	expect = []Segment{{3, 5}, {10, 11}}
+	if fmt.Sprint(missing) != fmt.Sprint(expect) {
+		t.Fatalf("got missing %v, expected %v", missing, expect)
+	}
+}
+
+func TestFileRandomAccess(t *testing.T) {
+	const rangeSize = 16 << 10
+
+	content := make([]byte, 20*rangeSize+77)
+	rand.Read(content)
+	srv, requested := newRangeServer(t, content)
+
+	r := New(rangeSize, 3)
+	f, err := r.openFile(context.Background(), newWorkers(srv, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Size() != int64(len(content)) {
+		t.Fatalf("got size %d, expected %d", f.Size(), len(content))
+	}
+
+	for i := 0; i < 50; i++ {
+		off := rand.Intn(len(content))
+		buf := make([]byte, rand.Intn(3*rangeSize)+1)
+		n, err := f.ReadAt(buf, int64(off))
+		if err != nil && !(errors.Is(err, io.EOF) && off+len(buf) > len(content)) {
+			t.Fatalf("ReadAt(%d, %d): %v", len(buf), off, err)
+		}
+		if !bytes.Equal(buf[:n], content[off:off+n]) {
+			t.Fatalf("ReadAt(%d, %d) content differs", len(buf), off)
+		}
+	}
+
+	// seek near the end and read the rest sequentially
+	if _, err := f.Seek(-int64(3*rangeSize), io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[len(content)-3*rangeSize:]) {
+		t.Fatal("sequential read after seek differs")
+	}
+
+	// a cached chunk is not fetched again
+	before := len(requested())
+	buf := make([]byte, 10)
+	if _, err := f.ReadAt(buf, int64(len(content)-20)); err != nil {
+		t.Fatal(err)
+	}
+	if after := len(requested()); after != before {
+		t.Fatalf("cached chunk was fetched again, %d requests, expected %d", after, before)
+	}
+
+	f.Close()
+	if _, err := f.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("read after close returned %v", err)
+	}
+}
+
+func TestChunkCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newChunkCache(2)
+	c.add(1, []byte{1})
+	c.add(2, []byte{2})
+	c.get(1)
+	c.add(3, []byte{3})
+
+	if _, ok := c.peek(2); ok {
+		t.Fatal("least recently used chunk was not evicted")
+	}
+	for _, index := range []int64{1, 3} {
+		if _, ok := c.peek(index); !ok {
+			t.Fatalf("chunk %d was evicted", index)
+		}
+	}
+}
+
+// newSlowServer serves content after delay, unless the request is cancelled first
+func newSlowServer(t *testing.T, content []byte, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the file size is answered right away
+		if r.Header.Get("Range") != "bytes=0-1" {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func downloadToTemp(t *testing.T, r *Range, workers chan worker) []byte {
+	dst := filepath.Join(t.TempDir(), "file")
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := r.writeFile(context.Background(), workers, f, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestSchedulerHedgesSlowWorker(t *testing.T) {
+	const rangeSize = 64 << 10
+
+	content := make([]byte, 8*rangeSize+9)
+	rand.Read(content)
+	fast, _ := newRangeServer(t, content)
+	slow := newSlowServer(t, content, 10*time.Second)
+
+	workers := make(chan worker, 2)
+	workers <- worker{c: slow.Client(), e: slow.URL}
+	workers <- worker{c: fast.Client(), e: fast.URL}
+
+	start := time.Now()
+	got := downloadToTemp(t, New(rangeSize, 3), workers)
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+
+	// the range held by the slow worker is fetched again by the fast one
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("download took %s, the tail was not hedged", elapsed)
+	}
+}
+
+func TestSchedulerEvictsFailingWorker(t *testing.T) {
+	const rangeSize = 16 << 10
+
+	content := make([]byte, 40*rangeSize)
+	rand.Read(content)
+	srv, _ := newRangeServer(t, content)
+
+	var failed atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	workers := make(chan worker, 2)
+	workers <- worker{c: failing.Client(), e: failing.URL}
+	workers <- worker{c: srv.Client(), e: srv.URL}
+
+	got := downloadToTemp(t, New(rangeSize, 3), workers)
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+
+	// the file size is asked once, then the worker is evicted after its consecutive failures
+	if n := failed.Load(); n > maxWorkerFailures+1 {
+		t.Fatalf("failing worker got %d requests, expected at most %d", n, maxWorkerFailures+1)
+	}
+}
+
+func TestDownloadStats(t *testing.T) {
+	const rangeSize = 16 << 10
+
+	content := make([]byte, 20*rangeSize)
+	rand.Read(content)
+	srv, _ := newRangeServer(t, content)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	workers := make(chan worker, 2)
+	workers <- worker{c: failing.Client(), e: failing.URL, nodeID: "bad"}
+	workers <- worker{c: srv.Client(), e: srv.URL, nodeID: "good"}
+
+	r := New(rangeSize, 3)
+	if st := r.Stats(); st.Total != 0 || st.Finished {
+		t.Fatalf("stats %+v before the download", st)
+	}
+
+	reader, progress, err := r.getFile(context.Background(), workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+	<-progress().Done
+
+	st := progress().Stats()
+	if !st.Finished || st.Err != nil || st.Done != st.Total || st.Total != int64(len(content)) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.Rate <= 0 || st.ETA != 0 {
+		t.Fatalf("rate %f and eta %s of a finished download", st.Rate, st.ETA)
+	}
+	if r.GetProgress() != 1 || r.GetWrittenBytes() != int64(len(content)) {
+		t.Fatalf("range progress %f, %d", r.GetProgress(), r.GetWrittenBytes())
+	}
+
+	nodes := make(map[string]NodeStats)
+	for _, ns := range st.Nodes {
+		nodes[ns.Node] = ns
+	}
+	if good := nodes["good"]; good.Bytes != int64(len(content)) || good.Ranges == 0 || good.Throughput <= 0 || good.Failures != 0 {
+		t.Fatalf("unexpected stats of the good node %+v", good)
+	}
+	// the failing node is evicted after maxWorkerFailures, unless the other one was faster
+	if bad := nodes["bad"]; bad.Bytes != 0 || bad.Failures == 0 || bad.Evicted != (bad.Failures >= maxWorkerFailures) {
+		t.Fatalf("unexpected stats of the failing node %+v", bad)
+	}
+}
+
+func TestSchedulerRangeSize(t *testing.T) {
+	s := &scheduler{d: &dispatcher{rangeSize: 1 << 20}}
+
+	for _, c := range []struct {
+		stats  workerStats
+		expect int64
+	}{
+		{workerStats{}, 1 << 20},
+		{workerStats{requests: 3, throughput: 100}, 256 << 10},
+		{workerStats{requests: 3, throughput: 2 << 20}, 2 << 20},
+		{workerStats{requests: 3, throughput: 1 << 30}, 4 << 20},
+	} {
+		if got := s.rangeSize(&c.stats); got != c.expect {
+			t.Fatalf("range size of %+v is %d, expected %d", c.stats, got, c.expect)
+		}
+	}
+}
+
+// newFailingRangeServer answers the file size but fails every range
+func newFailingRangeServer(t *testing.T, content []byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-1" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWriteFileRetryBudget(t *testing.T) {
+	content := make([]byte, 256<<10)
+	a, b := newFailingRangeServer(t, content), newFailingRangeServer(t, content)
+
+	workers := make(chan worker, 2)
+	workers <- worker{c: a.Client(), e: a.URL, nodeID: "node-a"}
+	workers <- worker{c: b.Client(), e: b.URL, nodeID: "node-b"}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := New(64<<10, 3, WithRetryBudget(1, 100))
+	_, err = r.writeFile(context.Background(), workers, f, nil)
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected a retry error, got %v", err)
+	}
+	if len(retryErr.Failures) == 0 {
+		t.Fatal("retry error has no failure")
+	}
+	for _, node := range []string{"node-a", "node-b", "status code: 502"} {
+		if !strings.Contains(err.Error(), node) {
+			t.Fatalf("error %q does not mention %s", err, node)
+		}
+	}
+}
+
+func TestGetFileFailsReader(t *testing.T) {
+	content := make([]byte, 256<<10)
+	srv := newFailingRangeServer(t, content)
+
+	r := New(64<<10, 3, WithRetryBudget(100, 4))
+	reader, _, err := r.getFile(context.Background(), newWorkers(srv, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected a retry error from the reader, got %v", err)
+	}
+	if len(retryErr.Failures) != 5 {
+		t.Fatalf("got %d failures, expected the download budget of 4 to be exceeded", len(retryErr.Failures))
+	}
+}
+
+// buffered returns the bytes written to the memory pipe and not read yet
+func (p *memoryPipe) buffered() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int64
+	for _, chunk := range p.chunks {
+		n += int64(len(chunk))
+	}
+	return n
+}
+
+func TestGetFileMemoryBuffer(t *testing.T) {
+	const (
+		rangeSize = 16 << 10
+		budget    = 3 * rangeSize
+	)
+
+	content := make([]byte, 30*rangeSize+5)
+	rand.Read(content)
+	srv, _ := newRangeServer(t, content)
+
+	r := New(rangeSize, 3, WithMemoryBuffer(), WithBufferBudget(budget))
+	reader, _, err := r.getFile(context.Background(), newWorkers(srv, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	pipe := reader.(*budgetReader).ReadCloser.(*memoryPipe)
+
+	// a slow consumer
+	var got []byte
+	buf := make([]byte, 4<<10)
+	for {
+		n, err := reader.Read(buf)
+		got = append(got, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond)
+		if buffered := pipe.buffered(); buffered > budget {
+			t.Fatalf("%d bytes buffered, over the budget of %d", buffered, budget)
+		}
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+}
+
+func TestMemoryPipe(t *testing.T) {
+	p := newMemoryPipe(10)
+	p.WriteAt([]byte("fghij"), 5)
+	p.WriteAt([]byte("abcde"), 0)
+
+	buf := make([]byte, 3)
+	var got []byte
+	for {
+		n, err := p.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+	}
+	if string(got) != "abcdefghij" {
+		t.Fatalf("read %q", got)
+	}
+
+	p = newMemoryPipe(10)
+	p.WriteAt([]byte("abc"), 0)
+	p.CloseWithError(errors.New("nodes are gone"))
+	if got, err := io.ReadAll(p); string(got) != "abc" || err == nil || err.Error() != "nodes are gone" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestBufferBudget(t *testing.T) {
+	b := newBufferBudget(100)
+	b.reserve(Segment{Start: 0, End: 40})
+	b.reserve(Segment{Start: 40, End: 80})
+	if got := b.available(); got != 20 {
+		t.Fatalf("available %d, expected 20", got)
+	}
+
+	b.consumedTo(50)
+	if got := b.available(); got != 60 {
+		t.Fatalf("available %d after consuming the first range, expected 60", got)
+	}
+	select {
+	case <-b.released():
+	default:
+		t.Fatal("release was not signaled")
+	}
+
+	b.release(Segment{Start: 40, End: 80})
+	if got := b.available(); got != 100 {
+		t.Fatalf("available %d after releasing everything, expected 100", got)
+	}
+
+	if newBufferBudget(0).available() <= 1<<40 {
+		t.Fatal("a budget of 0 is not unlimited")
+	}
+}
@@ -0,0 +1,369 @@
+package byterange
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// targetRangeDuration is the time a range should take on a worker, ranges are sized from the worker throughput
+	targetRangeDuration = time.Second
+	// minRangeDivisor bounds the smallest range to the range size divided by it
+	minRangeDivisor = 4
+	// maxRangeMultiplier bounds the largest range to the range size multiplied by it
+	maxRangeMultiplier = 4
+	// maxWorkerFailures is the number of consecutive failures after which a worker is evicted
+	maxWorkerFailures = 3
+	// maxJobCopies is the number of workers fetching the same range at the tail of a download
+	maxJobCopies = 2
+	// statsWeight is the weight of the last request in the throughput and error rate of a worker
+	statsWeight = 0.3
+)
+
+// workerStats tracks the throughput and the error rate of a worker
+type workerStats struct {
+	// throughput is the moving average of the bytes per second of the ranges fetched
+	throughput float64
+	// errorRate is the moving average of the failed requests
+	errorRate float64
+	// failures is the number of consecutive failed requests
+	failures int
+	// requests is the number of requests completed
+	requests int
+}
+
+func (s *workerStats) success(size int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	rate := float64(size) / elapsed.Seconds()
+
+	if s.requests == 0 || s.throughput == 0 {
+		s.throughput = rate
+	} else {
+		s.throughput = statsWeight*rate + (1-statsWeight)*s.throughput
+	}
+	s.errorRate = (1 - statsWeight) * s.errorRate
+	s.failures = 0
+	s.requests++
+}
+
+func (s *workerStats) failure() {
+	s.errorRate = statsWeight + (1-statsWeight)*s.errorRate
+	s.failures++
+	s.requests++
+}
+
+// score ranks the workers, the throughput discounted by the error rate
+func (s *workerStats) score() float64 {
+	return s.throughput * (1 - s.errorRate)
+}
+
+// fetchResult is the outcome of a range fetched by a worker
+type fetchResult struct {
+	w       worker
+	j       *job
+	data    []byte
+	err     error
+	elapsed time.Duration
+}
+
+// inflightJob is a range being fetched, by more than one worker once it is hedged
+type inflightJob struct {
+	j       *job
+	started time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// workers are the endpoints of the workers fetching the range
+	workers []string
+	// running is the number of fetches not returned yet
+	running int
+	// done is set once the range is delivered, the other fetches are cancelled
+	done bool
+}
+
+// scheduler hands the ranges of a download to the workers.
+// Ranges are sized from the throughput of each worker, failing workers are evicted,
+// and once nothing is left to fetch, the oldest ranges still running are duplicated to faster workers.
+// New ranges wait while the buffer budget is exhausted.
+// It is only used by the goroutine of dispatcher.run.
+type scheduler struct {
+	d *dispatcher
+	// pending are the segments not assigned yet
+	pending []Segment
+	// idle are the workers waiting for a range
+	idle     []worker
+	alive    int
+	stats    map[string]*workerStats
+	inflight map[int]*inflightJob
+	results  chan fetchResult
+	index    int
+	// failures are the failed fetches, reported once a retry budget is exhausted
+	failures []RangeFailure
+}
+
+func newScheduler(d *dispatcher) *scheduler {
+	s := &scheduler{
+		d:        d,
+		pending:  missingSegments(d.completed, d.fileSize),
+		stats:    make(map[string]*workerStats),
+		inflight: make(map[int]*inflightJob),
+	}
+
+	for len(d.workers) > 0 {
+		w := <-d.workers
+		s.idle = append(s.idle, w)
+		s.stats[w.e] = &workerStats{}
+	}
+	s.alive = len(s.idle)
+	// a worker runs a single fetch at a time, the fetches never block on the results
+	s.results = make(chan fetchResult, s.alive)
+
+	return s
+}
+
+// run fetches every missing segment and sends the ranges to d.resp
+func (s *scheduler) run(ctx context.Context) {
+	defer func() {
+		for _, inf := range s.inflight {
+			inf.cancel()
+		}
+	}()
+
+	var (
+		received  int64
+		remaining = s.d.remaining()
+	)
+
+	for received < remaining {
+		s.assign(ctx)
+
+		select {
+		case res := <-s.results:
+			delivered, ok := s.handle(ctx, res)
+			if !ok {
+				return
+			}
+			received += delivered
+		case <-s.d.budget.released():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// assign starts a fetch on every idle worker that has something to fetch, the fastest workers first
+func (s *scheduler) assign(ctx context.Context) {
+	sort.SliceStable(s.idle, func(i, j int) bool {
+		return s.stats[s.idle[i].e].score() > s.stats[s.idle[j].e].score()
+	})
+
+	idle := s.idle[:0]
+	for _, w := range s.idle {
+		if j := s.next(w); j != nil {
+			inf := &inflightJob{j: j, started: time.Now()}
+			inf.ctx, inf.cancel = context.WithCancel(ctx)
+			s.inflight[j.index] = inf
+			s.start(inf, w)
+			continue
+		}
+
+		if inf := s.hedge(w); inf != nil {
+			log.Printf("hedge range %d-%d of %s on %s", inf.j.start, inf.j.end, inf.workers[0], w.e)
+			s.start(inf, w)
+			continue
+		}
+
+		idle = append(idle, w)
+	}
+	s.idle = idle
+}
+
+// next returns a range to fetch, a failed range first, or nil if everything is assigned or the budget is exhausted
+func (s *scheduler) next(w worker) *job {
+	if j, ok := s.d.todos.Pop(); ok {
+		return j
+	}
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	size := s.rangeSize(s.stats[w.e])
+	// the workers pause while the consumer is behind
+	if available := s.d.budget.available(); available < size {
+		size = available
+	}
+	if size <= 0 {
+		return nil
+	}
+
+	seg := &s.pending[0]
+	end := seg.Start + size
+	if end >= seg.End {
+		end = seg.End
+	}
+
+	j := &job{index: s.index, start: seg.Start, end: end}
+	s.index++
+
+	seg.Start = end
+	if seg.Start >= seg.End {
+		s.pending = s.pending[1:]
+	}
+	s.d.budget.reserve(Segment{Start: j.start, End: j.end})
+
+	return j
+}
+
+// rangeSize returns the size of the next range of a worker, what it fetches in targetRangeDuration
+func (s *scheduler) rangeSize(st *workerStats) int64 {
+	minSize := s.d.rangeSize / minRangeDivisor
+	maxSize := s.d.rangeSize * maxRangeMultiplier
+	if minSize < 1 {
+		minSize = 1
+	}
+
+	if st.requests == 0 {
+		return s.d.rangeSize
+	}
+
+	size := int64(st.throughput * targetRangeDuration.Seconds())
+	switch {
+	case size < minSize:
+		return minSize
+	case size > maxSize:
+		return maxSize
+	}
+	return size
+}
+
+// hedge returns the oldest range still running on a slower worker than w, to fetch it again on w
+func (s *scheduler) hedge(w worker) *inflightJob {
+	score := s.stats[w.e].score()
+
+	var oldest *inflightJob
+	for _, inf := range s.inflight {
+		if inf.done || len(inf.workers) >= maxJobCopies || inf.running == 0 {
+			continue
+		}
+		if s.stats[inf.workers[0]].score() >= score {
+			continue
+		}
+		if oldest == nil || inf.started.Before(oldest.started) {
+			oldest = inf
+		}
+	}
+
+	return oldest
+}
+
+// start fetches the range of inf on w
+func (s *scheduler) start(inf *inflightJob, w worker) {
+	inf.workers = append(inf.workers, w.e)
+	inf.running++
+
+	j, retry := inf.j, inf.j.retry
+	go func() {
+		start := time.Now()
+		data, err := fetch(inf.ctx, w, j)
+		elapsed := time.Since(start)
+
+		if err != nil && retry > 0 {
+			log.Printf("[pull data failed] (retries: %d, from: %d, to: %d): %v", retry, j.start, j.end, err)
+			select {
+			case <-time.After(s.d.backoff.next(retry)):
+			case <-inf.ctx.Done():
+			}
+		}
+
+		s.results <- fetchResult{w: w, j: j, data: data, err: err, elapsed: elapsed}
+	}()
+}
+
+// fail stops the download with a *RetryError
+func (s *scheduler) fail(reason string) {
+	err := &RetryError{Reason: reason, Failures: s.failures}
+	log.Printf("%s", err.Error())
+	s.d.abort(err)
+}
+
+// handle records the result of a fetch and sends the range to the writer the first time it is fetched.
+// It returns the number of bytes delivered, and false if the download is stopped.
+func (s *scheduler) handle(ctx context.Context, res fetchResult) (int64, bool) {
+	st := s.stats[res.w.e]
+	inf := s.inflight[res.j.index]
+	inf.running--
+
+	dataLen := res.j.end - res.j.start
+	if res.err == nil && int64(len(res.data)) < dataLen {
+		res.err = fmt.Errorf("unexpected data size, want %d got %d", dataLen, len(res.data))
+	}
+
+	// another worker delivered the range first, this fetch was cancelled
+	if inf.done {
+		if res.err == nil {
+			st.success(dataLen, res.elapsed)
+		}
+		if inf.running == 0 {
+			delete(s.inflight, res.j.index)
+		}
+		s.idle = append(s.idle, res.w)
+		return 0, true
+	}
+
+	if res.err != nil {
+		if ctx.Err() != nil {
+			return 0, false
+		}
+
+		st.failure()
+		s.d.stats.failed(res.w.name())
+		s.failures = append(s.failures, RangeFailure{Start: res.j.start, End: res.j.end, Node: res.w.name(), Err: res.err})
+		if len(s.failures) > s.d.downloadRetries {
+			s.fail(fmt.Sprintf("%d fetches failed", len(s.failures)))
+			return 0, false
+		}
+
+		// the range is fetched again unless a copy is still running
+		if inf.running == 0 {
+			delete(s.inflight, res.j.index)
+			inf.cancel()
+			res.j.retry++
+			if res.j.retry > s.d.jobRetries {
+				s.fail(fmt.Sprintf("range %d-%d failed %d times", res.j.start, res.j.end, res.j.retry))
+				return 0, false
+			}
+			s.d.todos.PushFront(res.j)
+		}
+
+		if st.failures >= maxWorkerFailures && s.alive > 1 {
+			log.Printf("evict worker %s after %d failures: %v", res.w.e, st.failures, res.err)
+			s.alive--
+			s.d.stats.evicted(res.w.name())
+			return 0, true
+		}
+
+		s.idle = append(s.idle, res.w)
+		return 0, true
+	}
+
+	st.success(dataLen, res.elapsed)
+	s.d.stats.delivered(res.w.name(), dataLen, st.throughput)
+	inf.done = true
+	inf.cancel()
+	if inf.running == 0 {
+		delete(s.inflight, res.j.index)
+	}
+	s.idle = append(s.idle, res.w)
+
+	select {
+	case s.d.resp <- response{data: res.data[:dataLen], offset: res.j.start}:
+		return dataLen, true
+	case <-ctx.Done():
+		return 0, false
+	}
+}
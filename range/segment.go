@@ -0,0 +1,55 @@
+package byterange
+
+import "sort"
+
+// Segment is the byte range [Start, End) of a file
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// MergeSegments returns the segments sorted by start, with the overlapping and adjacent ones merged
+func MergeSegments(segs []Segment) []Segment {
+	sorted := make([]Segment, 0, len(segs))
+	for _, seg := range segs {
+		if seg.End > seg.Start {
+			sorted = append(sorted, seg)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	merged := sorted[:0]
+	for _, seg := range sorted {
+		if n := len(merged); n > 0 && seg.Start <= merged[n-1].End {
+			if seg.End > merged[n-1].End {
+				merged[n-1].End = seg.End
+			}
+			continue
+		}
+		merged = append(merged, seg)
+	}
+	return merged
+}
+
+// missingSegments returns the segments of [0, size) that are not in completed
+func missingSegments(completed []Segment, size int64) []Segment {
+	var (
+		missing []Segment
+		offset  int64
+	)
+	for _, seg := range MergeSegments(completed) {
+		if seg.Start >= size {
+			break
+		}
+		if seg.Start > offset {
+			missing = append(missing, Segment{Start: offset, End: seg.Start})
+		}
+		if seg.End > offset {
+			offset = seg.End
+		}
+	}
+	if offset < size {
+		missing = append(missing, Segment{Start: offset, End: size})
+	}
+	return missing
+}
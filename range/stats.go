@@ -0,0 +1,154 @@
+package byterange
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeStats is the contribution of a node to a download
+type NodeStats struct {
+	// Node is the node ID of the worker, or its endpoint without one
+	Node string
+	// Bytes is the size of the ranges delivered by the node
+	Bytes int64
+	// Ranges is the number of ranges delivered by the node
+	Ranges int
+	// Failures is the number of failed fetches of the node
+	Failures int
+	// Throughput is the moving average of the bytes per second of the node
+	Throughput float64
+	// Evicted is set once the node is not used anymore after consecutive failures
+	Evicted bool
+}
+
+// Stats is a snapshot of a download
+type Stats struct {
+	// Done is the number of bytes written, including the segments completed before a resumed download
+	Done int64
+	// Total is the file size
+	Total int64
+	// Elapsed is the time since the download started
+	Elapsed time.Duration
+	// Rate is the average number of bytes per second written since the download started
+	Rate float64
+	// ETA is the estimated time left, 0 while the rate is unknown
+	ETA time.Duration
+	// Nodes are the contributions of the nodes, in the order they first delivered or failed
+	Nodes []NodeStats
+	// Finished is set once the download stopped, Err is its error if it failed
+	Finished bool
+	Err      error
+}
+
+// downloadStats collects the statistics of a download, it is updated by the scheduler and the writer
+type downloadStats struct {
+	mu    sync.Mutex
+	start time.Time
+	// end is the time the download stopped
+	end   time.Time
+	total int64
+	// resumed is the size of the segments completed before the download
+	resumed  int64
+	written  int64
+	nodes    []*NodeStats
+	byNode   map[string]*NodeStats
+	finished bool
+	err      error
+}
+
+func newDownloadStats(total, resumed int64) *downloadStats {
+	return &downloadStats{
+		start:   time.Now(),
+		total:   total,
+		resumed: resumed,
+		byNode:  make(map[string]*NodeStats),
+	}
+}
+
+// node returns the stats of node, it is called with the lock held
+func (s *downloadStats) node(node string) *NodeStats {
+	ns, ok := s.byNode[node]
+	if !ok {
+		ns = &NodeStats{Node: node}
+		s.byNode[node] = ns
+		s.nodes = append(s.nodes, ns)
+	}
+	return ns
+}
+
+// delivered records a range of size delivered by node
+func (s *downloadStats) delivered(node string, size int64, throughput float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns := s.node(node)
+	ns.Bytes += size
+	ns.Ranges++
+	ns.Throughput = throughput
+}
+
+// failed records a failed fetch of node
+func (s *downloadStats) failed(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.node(node).Failures++
+}
+
+// evicted records that node is not used anymore
+func (s *downloadStats) evicted(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.node(node).Evicted = true
+}
+
+// wrote records size bytes written
+func (s *downloadStats) wrote(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written += size
+}
+
+// finish records the end of the download, err is nil once every byte is written
+func (s *downloadStats) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.end = time.Now()
+	s.err = err
+}
+
+// snapshot returns the current stats
+func (s *downloadStats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := time.Now()
+	if s.finished {
+		end = s.end
+	}
+
+	st := Stats{
+		Done:     s.resumed + s.written,
+		Total:    s.total,
+		Elapsed:  end.Sub(s.start),
+		Finished: s.finished,
+		Err:      s.err,
+		Nodes:    make([]NodeStats, 0, len(s.nodes)),
+	}
+	for _, ns := range s.nodes {
+		st.Nodes = append(st.Nodes, *ns)
+	}
+
+	if st.Elapsed > 0 {
+		st.Rate = float64(s.written) / st.Elapsed.Seconds()
+	}
+	if st.Rate > 0 && st.Done < st.Total {
+		st.ETA = time.Duration(float64(st.Total-st.Done) / st.Rate * float64(time.Second))
+	}
+
+	return st
+}
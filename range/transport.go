@@ -0,0 +1,316 @@
+package byterange
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// h3HandshakeTimeout bounds the QUIC handshake, so ProtocolAuto falls back to TCP in time
+	h3HandshakeTimeout = 2 * time.Second
+	// h3RetryAfter is the time a node HTTP/3 failed with is reached over TCP before HTTP/3 is tried again
+	h3RetryAfter = 5 * time.Minute
+)
+
+// Protocol selects the HTTP version used to download from the nodes
+type Protocol int
+
+const (
+	// ProtocolAuto uses HTTP/3, and HTTP/2 or HTTP/1.1 over TCP for the nodes HTTP/3 fails with
+	ProtocolAuto Protocol = iota
+	// ProtocolHTTP1 uses HTTP/1.1 only
+	ProtocolHTTP1
+	// ProtocolHTTP2 uses HTTP/2, or HTTP/1.1 for the nodes that do not negotiate it
+	ProtocolHTTP2
+	// ProtocolHTTP3 uses HTTP/3 only
+	ProtocolHTTP3
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolAuto:
+		return "auto"
+	case ProtocolHTTP1:
+		return "http/1.1"
+	case ProtocolHTTP2:
+		return "http/2"
+	case ProtocolHTTP3:
+		return "http/3"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// TransportConfig configures the connections to the nodes
+type TransportConfig struct {
+	Protocol Protocol
+	// TLSConfig is the base TLS configuration, for its RootCAs for instance, nil uses the system roots
+	TLSConfig *tls.Config
+	// InsecureSkipVerify accepts any certificate from the nodes that are not pinned
+	InsecureSkipVerify bool
+	// Pins are the certificates accepted by node ID or host, as the base64 SHA-256 of their SubjectPublicKeyInfo.
+	// The certificate of a pinned node must match one of its pins, it is not verified against the roots.
+	Pins map[string][]string
+}
+
+// Transport is the round-tripper shared by the workers of the downloads, it must be closed to release its connections
+type Transport struct {
+	cfg TransportConfig
+	tcp *http.Transport
+	h3  *http3.Transport
+	// tlsConfig is the base configuration of the TCP connections
+	tlsConfig *tls.Config
+
+	mu sync.Mutex
+	// nodes are the node IDs by host, to find the pins of a connection
+	nodes map[string]string
+	// h3Failed are the hosts HTTP/3 failed with, by time of the failure
+	h3Failed map[string]time.Time
+}
+
+var (
+	defaultTransport     *Transport
+	defaultTransportOnce sync.Once
+)
+
+// DefaultTransport returns the transport of the ranges created without WithTransport,
+// ProtocolAuto with the certificates verified against the system roots
+func DefaultTransport() *Transport {
+	defaultTransportOnce.Do(func() {
+		defaultTransport, _ = NewTransport(TransportConfig{})
+	})
+	return defaultTransport
+}
+
+// NewTransport returns a transport for cfg
+func NewTransport(cfg TransportConfig) (*Transport, error) {
+	if cfg.Protocol < ProtocolAuto || cfg.Protocol > ProtocolHTTP3 {
+		return nil, fmt.Errorf("unknown protocol %s", cfg.Protocol)
+	}
+
+	t := &Transport{
+		cfg:      cfg,
+		nodes:    make(map[string]string),
+		h3Failed: make(map[string]time.Time),
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	// the chain is verified by verifyConnection, which knows the pins of the node
+	tlsConfig.InsecureSkipVerify = true
+	t.tlsConfig = tlsConfig
+
+	if cfg.Protocol != ProtocolHTTP3 {
+		tcp := http.DefaultTransport.(*http.Transport).Clone()
+		tcp.DialTLSContext = t.dialTLS
+		tcp.ForceAttemptHTTP2 = cfg.Protocol != ProtocolHTTP1
+		t.tcp = tcp
+	}
+
+	if cfg.Protocol == ProtocolAuto || cfg.Protocol == ProtocolHTTP3 {
+		quicConfig := &quic.Config{}
+		if cfg.Protocol == ProtocolAuto {
+			quicConfig.HandshakeIdleTimeout = h3HandshakeTimeout
+		}
+		t.h3 = &http3.Transport{TLSClientConfig: tlsConfig.Clone(), QUICConfig: quicConfig, Dial: t.dialQUIC}
+	}
+
+	return t, nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case t.h3 == nil:
+		return t.tcp.RoundTrip(req)
+	case t.tcp == nil:
+		return t.h3.RoundTrip(req)
+	}
+
+	host := req.URL.Host
+	if !t.useH3(host) {
+		return t.tcp.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	// the request is sent again over TCP, with a new body
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	log.Printf("http/3 to %s failed, fall back to tcp: %v", host, err)
+	t.mu.Lock()
+	t.h3Failed[host] = time.Now()
+	t.mu.Unlock()
+
+	return t.tcp.RoundTrip(req)
+}
+
+// useH3 reports whether HTTP/3 is tried with host, it is not for a while after it failed
+func (t *Transport) useH3(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failed, ok := t.h3Failed[host]
+	if !ok {
+		return true
+	}
+	if time.Since(failed) > h3RetryAfter {
+		delete(t.h3Failed, host)
+		return true
+	}
+	return false
+}
+
+// Close closes the connections of the transport
+func (t *Transport) Close() error {
+	if t.tcp != nil {
+		t.tcp.CloseIdleConnections()
+	}
+	if t.h3 != nil {
+		return t.h3.Close()
+	}
+	return nil
+}
+
+// dialTLS opens a TLS connection to addr, the certificate is verified for the host of addr
+func (t *Transport) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := t.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.VerifyConnection = t.verifyConnection(host)
+	if t.cfg.Protocol == ProtocolHTTP1 {
+		cfg.NextProtos = []string{"http/1.1"}
+	} else {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialQUIC opens a QUIC connection to addr, the certificate is verified for the host of addr
+func (t *Transport) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg.VerifyConnection = t.verifyConnection(host)
+	return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+}
+
+// addNode records the node ID of the host of a worker, for its pins
+func (t *Transport) addNode(host, nodeID string) {
+	if nodeID == "" {
+		return
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[host] = nodeID
+}
+
+// pins returns the pins of the node at host
+func (t *Transport) pins(host string) []string {
+	t.mu.Lock()
+	nodeID := t.nodes[host]
+	t.mu.Unlock()
+
+	if pins, ok := t.cfg.Pins[nodeID]; ok && nodeID != "" {
+		return pins
+	}
+	return t.cfg.Pins[host]
+}
+
+// verifyConnection returns the check of the certificate of the node at host, against its pins, or against the roots if it has none.
+// The host is not taken from the connection state, which has no server name for the IP addresses.
+func (t *Transport) verifyConnection(host string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate from the node")
+		}
+		leaf := cs.PeerCertificates[0]
+
+		if pins := t.pins(host); len(pins) > 0 {
+			fingerprint := CertificatePin(leaf)
+			for _, pin := range pins {
+				if pin == fingerprint {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate of %s does not match its pins, got %s", host, fingerprint)
+		}
+
+		if t.cfg.InsecureSkipVerify {
+			return nil
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Intermediates: x509.NewCertPool(),
+			Roots:         t.tlsConfig.RootCAs,
+		}
+		if t.tlsConfig.ServerName != "" {
+			opts.DNSName = t.tlsConfig.ServerName
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
+
+// CertificatePin returns the pin of cert, to set in TransportConfig.Pins
+func CertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,121 @@
+package byterange
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTLSServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *Transport, u string) (string, error) {
+	resp, err := (&http.Client{Transport: t}).Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Proto, nil
+}
+
+func TestTransportVerifiesCertificates(t *testing.T) {
+	srv := newTLSServer(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tr, err := NewTransport(TransportConfig{Protocol: ProtocolHTTP2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, err := get(tr, srv.URL); err == nil {
+		t.Fatal("a certificate outside of the system roots was accepted")
+	}
+
+	tr, err = NewTransport(TransportConfig{Protocol: ProtocolHTTP2, TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if proto, err := get(tr, srv.URL); err != nil || proto != "HTTP/2.0" {
+		t.Fatalf("got %s, %v with the roots of the server", proto, err)
+	}
+
+	tr, err = NewTransport(TransportConfig{Protocol: ProtocolHTTP1, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if proto, err := get(tr, srv.URL); err != nil || proto != "HTTP/1.1" {
+		t.Fatalf("got %s, %v without verification over http/1.1", proto, err)
+	}
+}
+
+func TestTransportPins(t *testing.T) {
+	srv := newTLSServer(t)
+	u, _ := url.Parse(srv.URL)
+
+	pinned, err := NewTransport(TransportConfig{
+		Protocol: ProtocolHTTP2,
+		Pins:     map[string][]string{"node-1": {"bm90IHRoZSBwaW4=", CertificatePin(srv.Certificate())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Close()
+	pinned.addNode(u.Host, "node-1")
+
+	if _, err := get(pinned, srv.URL); err != nil {
+		t.Fatalf("pinned certificate was rejected: %v", err)
+	}
+
+	// the pins of a node replace the verification, even when it is skipped for the others
+	wrong, err := NewTransport(TransportConfig{
+		Protocol:           ProtocolHTTP2,
+		InsecureSkipVerify: true,
+		Pins:               map[string][]string{"node-1": {"bm90IHRoZSBwaW4="}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrong.Close()
+	wrong.addNode(u.Host, "node-1")
+
+	if _, err := get(wrong, srv.URL); err == nil || !strings.Contains(err.Error(), "does not match its pins") {
+		t.Fatalf("expected a pin mismatch, got %v", err)
+	}
+}
+
+func TestTransportFallsBackFromHTTP3(t *testing.T) {
+	// the server only listens on tcp
+	srv := newTLSServer(t)
+
+	tr, err := NewTransport(TransportConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	if proto, err := get(tr, srv.URL); err != nil || proto != "HTTP/2.0" {
+		t.Fatalf("got %s, %v after the fallback", proto, err)
+	}
+
+	u, _ := url.Parse(srv.URL)
+	if tr.useH3(u.Host) {
+		t.Fatal("http/3 is tried again right after it failed")
+	}
+
+	if _, err := NewTransport(TransportConfig{Protocol: Protocol(42)}); err == nil {
+		t.Fatal("unknown protocol was accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+const replicaCancelled = "cancelled after quorum"
+
+// WithReplicas sets how many endpoints the car is pushed to at the same time, default is 1.
+// An endpoint that fails is replaced by the next endpoint returned by the scheduler.
+func WithReplicas(n int) RequestOption {
+	return requestSetting(func(o *requestSettings) {
+		o.replicas = n
+	})
+}
+
+// WithQuorum sets how many endpoints must acknowledge the car before the upload succeeds, default is 1.
+// The uploads still running when the quorum is reached are cancelled.
+func WithQuorum(k int) RequestOption {
+	return requestSetting(func(o *requestSettings) {
+		o.quorum = k
+	})
+}
+
+// replicaUpload describes a car to push to the endpoints of an asset
+type replicaUpload struct {
+	root cid.Cid
+	name string
+	size int64
+	// open returns a new reader of the car for every endpoint
+	open     func() (io.ReadCloser, error)
+	replicas int
+	quorum   int
+}
+
+// uploadReplicas pushes the car to up to u.replicas endpoints concurrently and returns
+// once u.quorum of them acknowledged it. The outcome of every tried node is reported in
+// the log of the transfer report. The returned map holds the error of every endpoint
+// that was tried, keyed by its candidate address, nil for the endpoints that succeeded.
+func (s *storage) uploadReplicas(ctx context.Context, endpoints []*client.Endpoint, u *replicaUpload, progress ProgressFunc) (map[string]error, error) {
+	if u.quorum > len(endpoints) {
+		return nil, fmt.Errorf("quorum %d exceeds the %d endpoints", u.quorum, len(endpoints))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ep   *client.Endpoint
+		slot int
+		err  error
+	}
+
+	var (
+		results   = make(chan result)
+		rp        = newReplicaProgress(len(endpoints), u.quorum, progress)
+		errs      = make(map[string]error)
+		outcomes  = make(map[string]string)
+		start     = time.Now()
+		next      int
+		running   int
+		succeeded int
+		lastErr   error
+		report    = &client.AssetTransferReq{
+			TotalSize:    u.size,
+			TransferType: client.AssetTransferTypeUpload,
+			Cid:          u.root.String(),
+			State:        client.AssetTransferStateFailed,
+		}
+	)
+
+	launch := func() {
+		ep, slot := endpoints[next], next
+		next++
+		running++
+
+		go func() {
+			r, err := u.open()
+			if err == nil {
+				_, err = s.uploadFileWithForm(ctx, r, u.size, u.name, ep.CandidateAddr, ep.Token, ep.TraceID, func(doneSize, totalSize int64) {
+					rp.update(slot, doneSize, totalSize)
+				})
+				r.Close()
+			}
+			results <- result{ep: ep, slot: slot, err: err}
+		}()
+	}
+
+	for running < u.replicas && next < len(endpoints) {
+		launch()
+	}
+
+	for running > 0 {
+		res := <-results
+		running--
+
+		nodeID := getNodeIdFromCandidateAddr(res.ep.CandidateAddr)
+		if nodeID == "" {
+			nodeID = res.ep.CandidateAddr
+		}
+		errs[res.ep.CandidateAddr] = res.err
+
+		if res.err == nil {
+			succeeded++
+			outcomes[nodeID] = "success"
+			report.NodeID = joinNodeID(report.NodeID, nodeID)
+			if report.TraceID == "" {
+				report.TraceID = res.ep.TraceID
+			}
+			if succeeded == u.quorum {
+				// quorum reached, cancel the stragglers
+				cancel()
+			}
+			continue
+		}
+
+		rp.reset(res.slot)
+
+		if succeeded >= u.quorum {
+			outcomes[nodeID] = res.err.Error()
+			if errors.Is(res.err, context.Canceled) {
+				outcomes[nodeID] = replicaCancelled
+			}
+			continue
+		}
+
+		log.Printf("upload %s to %s error %s", u.root.String(), res.ep.CandidateAddr, res.err.Error())
+		outcomes[nodeID] = res.err.Error()
+		lastErr = res.err
+
+		if ctx.Err() == nil && next < len(endpoints) && succeeded+running+len(endpoints)-next >= u.quorum {
+			launch()
+		}
+	}
+
+	report.CostMs = time.Since(start).Milliseconds()
+	if succeeded >= u.quorum {
+		report.State = client.AssetTransferStateSuccess
+	}
+	if b, err := json.Marshal(outcomes); err == nil {
+		report.Log = string(b)
+	}
+
+	if err := s.webAPI.AssetTransferReport(context.Background(), *report); err != nil {
+		log.Printf("failed to send transfer report, %s", err.Error())
+	}
+
+	if succeeded < u.quorum {
+		if lastErr == nil {
+			lastErr = ctx.Err()
+		}
+		return errs, fmt.Errorf("upload %s reached %d of quorum %d: %w", u.root.String(), succeeded, u.quorum, lastErr)
+	}
+
+	return errs, nil
+}
+
+// replicaProgress reports the progress of the replica that is the last one needed for the quorum
+type replicaProgress struct {
+	lock     sync.Mutex
+	done     []int64
+	quorum   int
+	progress ProgressFunc
+}
+
+func newReplicaProgress(slots, quorum int, progress ProgressFunc) *replicaProgress {
+	return &replicaProgress{done: make([]int64, slots), quorum: quorum, progress: progress}
+}
+
+func (p *replicaProgress) update(slot int, doneSize, totalSize int64) {
+	if p.progress == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.done[slot] = doneSize
+
+	sorted := append([]int64(nil), p.done...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	p.progress(sorted[p.quorum-1], totalSize)
+}
+
+// reset forgets the progress of a replica that failed
+func (p *replicaProgress) reset(slot int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.done[slot] = 0
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// candidateAddr returns an upload address of srv whose host does not look like a node id,
+// so the outcomes are reported by address
+func candidateAddr(srv *httptest.Server) string {
+	return strings.Replace(srv.URL, "127.0.0.1", "localhost", 1) + "/upload"
+}
+
+// replicaReport returns the aggregate report sent by uploadReplicas
+func replicaReport(t *testing.T, web *fakeWebserver) (client.AssetTransferReq, map[string]string) {
+	web.mu.Lock()
+	defer web.mu.Unlock()
+
+	for _, r := range web.reports {
+		if r.Log == "" {
+			continue
+		}
+		outcomes := make(map[string]string)
+		if err := json.Unmarshal([]byte(r.Log), &outcomes); err != nil {
+			t.Fatalf("decode report log %q: %v", r.Log, err)
+		}
+		return r, outcomes
+	}
+
+	t.Fatalf("no replica report in %+v", web.reports)
+	return client.AssetTransferReq{}, nil
+}
+
+func TestUploadReplicasQuorum(t *testing.T) {
+	var uploads [][]byte
+	failing := newUploadServer(t, http.StatusInternalServerError, nil)
+	first := newUploadServer(t, http.StatusOK, &uploads)
+	second := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{
+		{CandidateAddr: candidateAddr(failing)},
+		{CandidateAddr: candidateAddr(first)},
+		{CandidateAddr: candidateAddr(second)},
+	}}
+	s := &storage{webAPI: web}
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	root, err := s.UploadStream(context.Background(), bytes.NewReader(content), "titan.txt", nil, WithReplicas(2), WithQuorum(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 2 {
+		t.Fatalf("got %d uploads, want 2", len(uploads))
+	}
+	if !bytes.Equal(uploads[0], uploads[1]) {
+		t.Fatal("replicas received different cars")
+	}
+	if len(web.deleted) != 0 {
+		t.Fatalf("asset deleted after the quorum was reached: %v", web.deleted)
+	}
+
+	report, outcomes := replicaReport(t, web)
+	if report.State != client.AssetTransferStateSuccess || report.Cid != root.String() {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if outcomes[candidateAddr(first)] != "success" || outcomes[candidateAddr(second)] != "success" || outcomes[candidateAddr(failing)] == "success" || outcomes[candidateAddr(failing)] == "" {
+		t.Fatalf("unexpected outcomes %v", outcomes)
+	}
+}
+
+func TestUploadReplicasCancelStragglers(t *testing.T) {
+	var uploads [][]byte
+	working := newUploadServer(t, http.StatusOK, &uploads)
+
+	cancelled := make(chan struct{})
+	straggler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server notices the client went away only once the body is consumed
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	t.Cleanup(straggler.Close)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{
+		{CandidateAddr: candidateAddr(straggler)},
+		{CandidateAddr: candidateAddr(working)},
+	}}
+	s := &storage{webAPI: web}
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	if _, err := s.UploadStream(context.Background(), bytes.NewReader(content), "titan.txt", nil, WithReplicas(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("straggler was not cancelled")
+	}
+
+	_, outcomes := replicaReport(t, web)
+	if outcomes[candidateAddr(working)] != "success" || outcomes[candidateAddr(straggler)] != replicaCancelled {
+		t.Fatalf("unexpected outcomes %v", outcomes)
+	}
+}
+
+func TestUploadReplicasQuorumNotReached(t *testing.T) {
+	var uploads [][]byte
+	failing := newUploadServer(t, http.StatusInternalServerError, nil)
+	working := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{
+		{CandidateAddr: candidateAddr(failing)},
+		{CandidateAddr: candidateAddr(working)},
+	}}
+	s := &storage{webAPI: web}
+
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	if _, err := s.UploadStream(context.Background(), bytes.NewReader(content), "titan.txt", nil, WithQuorum(2)); err == nil {
+		t.Fatal("upload succeeded without quorum")
+	}
+
+	if len(web.deleted) != 1 || web.deleted[0] != web.created[0].AssetCID {
+		t.Fatalf("asset not deleted: %v", web.deleted)
+	}
+
+	report, _ := replicaReport(t, web)
+	if report.State != client.AssetTransferStateFailed {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestRequestOptionsKeepAssetPropertyOptions(t *testing.T) {
+	// an option written against the asset property, as before the upload settings existed
+	var named RequestOption = func(ap *client.AssetProperty) {
+		ap.AssetName = "named"
+	}
+
+	o := newRequestOptions(client.AssetProperty{GroupID: 1}, []RequestOption{named, WithReplicas(3), WithQuorum(2), WithGroupID(4)})
+	if o.AssetName != "named" || o.GroupID != 4 || o.replicas != 3 || o.quorum != 2 {
+		t.Fatalf("options not applied: %+v", o)
+	}
+
+	// the settings are recorded in any asset property the options are applied to
+	ap := &client.AssetProperty{}
+	WithReplicas(3)(ap)
+	WithGroupID(4)(ap)
+	if settings, ok := ap.Settings.(*requestSettings); !ok || settings.replicas != 3 || ap.GroupID != 4 {
+		t.Fatalf("options not applied: %+v", ap)
+	}
+
+	// the settings stay out of the asset of the request
+	if o.Settings != nil {
+		t.Fatalf("settings left in the asset property %+v", o.AssetProperty)
+	}
+	if b, err := json.Marshal(ap); err != nil || strings.Contains(string(b), "Settings") {
+		t.Fatalf("settings in the asset property json %s, %v", b, err)
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// contentSource gives fresh readers over a content of known size
+type contentSource interface {
+	// Open returns a new reader from the beginning of the content
+	Open() io.Reader
+	// Size returns the size of the content
+	Size() int64
+}
+
+// replayableSource gives fresh readers over the content of a stream, so the content
+// can be read more than once without holding it in memory.
+// Streams without random access are spooled to a temporary file.
+type replayableSource struct {
+	ra    io.ReaderAt
+	start int64
+	size  int64
+	temp  *os.File
+}
+
+// newReplayableSource wraps r, the content starts at the current offset of r
+func newReplayableSource(r io.Reader) (*replayableSource, error) {
+	if rs, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		if src, err := seekableSource(rs); err == nil {
+			return src, nil
+		}
+	}
+
+	temp, err := os.CreateTemp("", "titan-stream-*")
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := io.Copy(temp, r)
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, err
+	}
+
+	return &replayableSource{ra: temp, size: size, temp: temp}, nil
+}
+
+// seekableSource fails for readers that only pretend to seek, like pipes opened as *os.File
+func seekableSource(rs interface {
+	io.ReaderAt
+	io.Seeker
+}) (*replayableSource, error) {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &replayableSource{ra: rs, start: start, size: end - start}, nil
+}
+
+// Open returns a new reader from the beginning of the content
+func (s *replayableSource) Open() io.Reader {
+	return io.NewSectionReader(s.ra, s.start, s.size)
+}
+
+// Size returns the size of the content
+func (s *replayableSource) Size() int64 {
+	return s.size
+}
+
+// Close removes the temporary file if the content was spooled
+func (s *replayableSource) Close() error {
+	if s.temp == nil {
+		return nil
+	}
+
+	s.temp.Close()
+	return os.Remove(s.temp.Name())
+}
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -24,8 +25,73 @@ import (
 // FileType represents the type of file or folder
 type FileType string
 
+// RequestOption customizes an upload request.
+// It is applied to the asset property sent to the scheduler, the options of the SDK like WithReplicas or WithEncryption
+// also record upload settings in the Settings of the asset property.
 type RequestOption func(*client.AssetProperty)
 
+// requestOptions holds the asset property sent to the scheduler and the upload settings
+type requestOptions struct {
+	client.AssetProperty
+	requestSettings
+}
+
+// requestSettings are the upload settings of a request, the options of the SDK record them
+// in the Settings of the asset property they are applied to
+type requestSettings struct {
+	// replicas is the number of endpoints the car is pushed to concurrently
+	replicas int
+	// quorum is the number of endpoints that must acknowledge the car
+	quorum int
+	// keyProvider wraps the data key of an encrypted upload
+	keyProvider KeyProvider
+	// dedup is the policy for content the user already owns
+	dedup DedupPolicy
+	// entryNames are the names of the paths given to UploadFiles
+	entryNames map[string]string
+	// dag builds the car locally with these options instead of the default of the nodes
+	dag *DagOptions
+}
+
+// requestSetting returns an option changing the upload settings recorded in the asset property it is applied to
+func requestSetting(set func(o *requestSettings)) RequestOption {
+	return func(ap *client.AssetProperty) {
+		settings, ok := ap.Settings.(*requestSettings)
+		if !ok {
+			settings = &requestSettings{replicas: 1, quorum: 1}
+			ap.Settings = settings
+		}
+		set(settings)
+	}
+}
+
+// newRequestOptions applies options on top of the default asset property
+func newRequestOptions(ap client.AssetProperty, options []RequestOption) *requestOptions {
+	o := &requestOptions{AssetProperty: ap}
+	o.Settings = &requestSettings{replicas: 1, quorum: 1}
+
+	for _, opt := range options {
+		opt(&o.AssetProperty)
+	}
+
+	if settings, ok := o.Settings.(*requestSettings); ok {
+		o.requestSettings = *settings
+	} else {
+		o.requestSettings = requestSettings{replicas: 1, quorum: 1}
+	}
+	// the settings are not part of the asset
+	o.Settings = nil
+
+	if o.quorum < 1 {
+		o.quorum = 1
+	}
+	if o.replicas < o.quorum {
+		o.replicas = o.quorum
+	}
+
+	return o
+}
+
 const (
 	FileTypeFile   FileType = "file"
 	FileTypeFolder FileType = "folder"
@@ -43,6 +109,10 @@ type UploadFileResult struct {
 // ProgressFunc is a function type for reporting progress during file uploads
 type ProgressFunc func(doneSize int64, totalSize int64)
 
+// FileProgressFunc is a function type for reporting the progress of every file of a folder download,
+// path is the slash separated path of the file in the folder
+type FileProgressFunc func(path string, doneSize int64, totalSize int64)
+
 // Storage is an interface for interacting with titan storage
 type Storage interface {
 
@@ -69,6 +139,13 @@ type Storage interface {
 	// DeleteFolder delete special folder
 	DeleteFolder(ctx context.Context, folderID int) error
 
+	// MoveAsset moves a specific file into the folder targetGroup, 0 is the root
+	MoveAsset(ctx context.Context, assetCID string, targetGroup int) error
+
+	// MoveFolder moves a specific folder with its content under the folder targetParent, 0 is the root.
+	// It returns ErrMoveCycle if targetParent is the folder itself or one of its subfolders.
+	MoveFolder(ctx context.Context, folderID, targetParent int) error
+
 	// DeleteAsset Delete a specific file
 	// It returns any error encountered during the deletion process.
 	DeleteAsset(ctx context.Context, rootCID string) error
@@ -85,15 +162,59 @@ type Storage interface {
 	// UploadAsset Upload files/folders
 	UploadAsset(ctx context.Context, filePath string, reader io.Reader, progress ProgressFunc, options ...RequestOption) (cid cid.Cid, err error)
 
+	// UploadDirectory mirrors a local directory into groups and uploads every file into the group of its directory.
+	// It returns a manifest of the uploaded files and the groups of the directories.
+	UploadDirectory(ctx context.Context, dirPath string, progress ProgressFunc, options ...RequestOption) (*DirectoryManifest, error)
+
+	// UploadFiles uploads files and folders as a single folder asset, wrapped in a directory under their names.
+	// if name is empty, name will be the root cid
+	UploadFiles(ctx context.Context, paths []string, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error)
+
+	// UploadCar uploads a CARv1 or CARv2 built by other tools, after checking its blocks and the completeness of its dag.
+	// if name is empty, name will be the root cid
+	UploadCar(ctx context.Context, r io.Reader, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error)
+
 	// UploadAssetWithUrl
 	UploadAssetWithUrl(ctx context.Context, url string) (cid cid.Cid, fileName string, err error)
 
 	// DownloadAsset Download files/folders
-	DownloadAsset(ctx context.Context, assetCID string) (io.ReadCloser, string, error)
+	// WithVerification checks the content of a file against assetCID while it is read.
+	// WithCarRetrieval downloads it as a car verified block by block.
+	// WithDownloadProgress reports the progress of a range download, its reader implements StatsReader.
+	DownloadAsset(ctx context.Context, assetCID string, options ...DownloadOption) (io.ReadCloser, string, error)
+
+	// DownloadToFile downloads an asset into filePath with parallel ranged writes.
+	// An interrupted download resumes from the sidecar state kept next to filePath when it is called again.
+	DownloadToFile(ctx context.Context, assetCID, filePath string, options ...DownloadOption) error
+
+	// DownloadTrustless downloads an asset as a car, verifies every block against its CID
+	// and reassembles the file or the directory tree of a folder at destPath.
+	DownloadTrustless(ctx context.Context, assetCID, destPath string) error
+
+	// DownloadDirectory downloads a folder asset into destDir, recreating its subdirectories and files.
+	// The directory dag is walked with verified block fetches, or from a single car WithCarRetrieval,
+	// and the files are fetched in parallel.
+	DownloadDirectory(ctx context.Context, rootCID, destDir string, progress FileProgressFunc, options ...DownloadOption) error
+
+	// OpenAsset opens an asset for random access, chunks are fetched on demand with a read-ahead window and a LRU cache.
+	OpenAsset(ctx context.Context, assetCID string) (AssetReader, error)
 
 	// SetArea set areas before upload or download files
 	SetAreas(ctx context.Context, area []string)
 
+	// StartUploadSession builds the car of a file, folder or stream and persists a resumable upload session.
+	// If a session for the same content already exists, the existing session is returned.
+	StartUploadSession(ctx context.Context, filePath string, reader io.Reader, name string, options ...RequestOption) (*UploadSession, error)
+
+	// ResumeUploadSession continues the upload session of rootCID from its last persisted state.
+	ResumeUploadSession(ctx context.Context, rootCID string, progress ProgressFunc) (cid.Cid, error)
+
+	// AbortUploadSession removes the upload session of rootCID, deleting the asset if it was not uploaded.
+	AbortUploadSession(ctx context.Context, rootCID string) error
+
+	// ListUploadSessions returns the unfinished upload sessions in the session directory.
+	ListUploadSessions(ctx context.Context) ([]*UploadSession, error)
+
 	// ------------------------------ Functions blow will be legacy -------------------------------------
 
 	// UploadFilesWithPath uploads files from the local file system to the titan storage.
@@ -103,7 +224,7 @@ type Storage interface {
 
 	// FetchBlockFromRoot fetch single block from rootCID
 	// It returns the block and any error encountered.
-	FetchBlockFromRoot(ctx context.Context, rootCid, subCid string) (io.ReadCloser, error)
+	FetchBlockFromRoot(ctx context.Context, rootCid, subCid string, options ...DownloadOption) (io.ReadCloser, error)
 
 	// ListAllBlocks retrieves a list of all blocks associated with the specified rootCID.
 	ListAllBlocks(ctx context.Context, rootCid string) ([]string, error)
@@ -133,7 +254,8 @@ type Storage interface {
 	// GetFileWithCid retrieves the file content associated with the specified rootCID from the titan storage.
 	// parallel means multiple concurrent download tasks.
 	// It returns an io.ReadCloser for reading the file content and filename and any error encountered during the retrieval process.
-	GetFileWithCid(ctx context.Context, rootCID string) (io.ReadCloser, string, error)
+	// The reader implements StatsReader, WithDownloadProgress reports the same stats while the file is fetched.
+	GetFileWithCid(ctx context.Context, rootCID string, options ...DownloadOption) (io.ReadCloser, string, error)
 	// CreateGroup create a group
 	CreateGroup(ctx context.Context, name string, parentID int) error
 	// ListGroup list groups
@@ -146,13 +268,29 @@ type Storage interface {
 // storage is the implementation of the Storage interface
 type storage struct {
 	webAPI client.Webserver
-	// httpClient  *http.Client
+	// nodeClient sends the requests to the nodes, with the node middlewares of the config
+	nodeClient *http.Client
+	// externalClient fetches the URLs given by the caller, without any middleware
+	externalClient *http.Client
+	// nodeMiddlewares wrap the transport of the range downloads
+	nodeMiddlewares []client.Middleware
+
 	candidateID string
 	userID      string
 	// Setting the directory for file uploads
 	// default is 0, 0 is root directory
 	groupID int
 	areas   []string
+	// directory of the resumable upload sessions
+	sessionDir string
+	// keyProvider encrypts uploads made WithEncryption and decrypts downloads
+	keyProvider KeyProvider
+	// downloadTransport connects to the nodes the assets are downloaded from, nil uses byterange.DefaultTransport
+	downloadTransport *byterange.Transport
+	// downloadBufferBudget bounds the bytes of a download fetched ahead of its reader, 0 does not bound them
+	downloadBufferBudget int64
+	// downloadMemoryBuffer reorders the ranges of DownloadAsset and GetFileWithCid in memory instead of a temporary file
+	downloadMemoryBuffer bool
 }
 
 type Config struct {
@@ -162,13 +300,55 @@ type Config struct {
 	//
 	// APIKey is used for long-lived access.
 	// Token is created after you have logged in with expire time.
-	APIKey string
-	Token  string
+	// TokenSource replaces Token with tokens refreshed before they expire, see TenantTokenSource.
+	APIKey      string
+	Token       string
+	TokenSource client.TokenSource
 
 	// Setting the directory for file uploads
 	// default is 0, 0 is root directory
 	GroupID     int
 	UseFastNode bool
+
+	// SessionDir is the directory to keep the state and car of resumable upload sessions.
+	// default is titan-upload-sessions in the temporary directory
+	SessionDir string
+
+	// KeyProvider wraps the data keys of uploads made WithEncryption.
+	// Assets uploaded encrypted are decrypted with it when they are downloaded, and cannot be downloaded without it.
+	KeyProvider KeyProvider
+
+	// DownloadTransport sets the protocol, the TLS verification and the certificate pins of the connections to the nodes
+	// assets are downloaded from. It is shared by the downloads and closed by its owner.
+	// default is byterange.DefaultTransport, HTTP/3 with a TCP fallback and the certificates verified against the system roots
+	DownloadTransport *byterange.Transport
+	// DownloadBufferBudget bounds the bytes of a download fetched ahead of its reader, in flight or buffered.
+	// default is 0, the ranges are fetched as fast as the nodes serve them
+	DownloadBufferBudget int64
+	// DownloadMemoryBuffer makes DownloadAsset and GetFileWithCid reorder the ranges in memory instead of a temporary file,
+	// the memory is bounded by DownloadBufferBudget, 32 MiB if it is 0
+	DownloadMemoryBuffer bool
+
+	// HTTPClient sends the calls to the web API only, for its timeout or its proxy for instance.
+	// default is http.DefaultClient
+	HTTPClient *http.Client
+	// HTTPTransport replaces the transport of HTTPClient
+	HTTPTransport http.RoundTripper
+	// Middlewares wrap the calls to the web API only, the first one sees the requests first.
+	// client.SetHeader, client.UserAgent, client.RequestID and client.Logging are common ones.
+	Middlewares []client.Middleware
+
+	// NodeHTTPClient sends the uploads and the block and car fetches to the nodes, and fetches the URLs of UploadFileWithURL.
+	// Its timeout bounds a whole upload, leave it unset for large files.
+	// default is http.DefaultClient
+	NodeHTTPClient *http.Client
+	// NodeMiddlewares wrap the requests to the nodes, including the range downloads.
+	// The nodes are authenticated with their own tokens, the credentials of the web API must not be set here.
+	// The URLs of UploadFileWithURL are fetched without any middleware.
+	NodeMiddlewares []client.Middleware
+	// RetryPolicy retries the web API calls that fail with a connection error, a 5xx or a 429.
+	// default is client.DefaultRetryPolicy, client.NoRetry disables the retries
+	RetryPolicy *client.RetryPolicy
 }
 
 var TitanAreas []string
@@ -178,7 +358,7 @@ func Initialize(cfg *Config) (Storage, error) {
 	if len(cfg.TitanURL) == 0 {
 		return nil, fmt.Errorf("TitanURL can not empty")
 	}
-	if len(cfg.APIKey) == 0 && len(cfg.Token) == 0 {
+	if len(cfg.APIKey) == 0 && len(cfg.Token) == 0 && cfg.TokenSource == nil {
 		return nil, fmt.Errorf("APIKey or Token can not empty")
 	}
 	// tlsConfig := tls.Config{InsecureSkipVerify: true}
@@ -195,7 +375,18 @@ func Initialize(cfg *Config) (Storage, error) {
 	// headers := http.Header{}
 	// headers.Add("Authorization", "Bearer "+cfg.APIKey)
 
-	webAPI := client.NewWebserver(cfg.TitanURL, cfg.APIKey, cfg.Token)
+	webClient := client.HTTPConfig{Client: cfg.HTTPClient, Transport: cfg.HTTPTransport, Middlewares: cfg.Middlewares}.NewClient()
+	nodeClient := client.HTTPConfig{Client: cfg.NodeHTTPClient, Middlewares: cfg.NodeMiddlewares}.NewClient()
+	externalClient := client.HTTPConfig{Client: cfg.NodeHTTPClient}.NewClient()
+
+	webOptions := []client.Option{client.WithHTTPClient(webClient)}
+	if cfg.RetryPolicy != nil {
+		webOptions = append(webOptions, client.WithRetryPolicy(*cfg.RetryPolicy))
+	}
+	if cfg.TokenSource != nil {
+		webOptions = append(webOptions, client.WithTokenSource(cfg.TokenSource))
+	}
+	webAPI := client.NewWebserver(cfg.TitanURL, cfg.APIKey, cfg.Token, webOptions...)
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -212,7 +403,7 @@ func Initialize(cfg *Config) (Storage, error) {
 			return nil, fmt.Errorf("GetCandidateIPs %w", err)
 		}
 
-		fastNodes := getFastNodes(candidates)
+		fastNodes := getFastNodes(nodeClient, candidates)
 		if len(fastNodes) > 0 {
 			fastNodeID = fastNodes[0].NodeID
 			fmt.Println("use fastest node ", fastNodeID)
@@ -226,7 +417,12 @@ func Initialize(cfg *Config) (Storage, error) {
 		return nil, err
 	}
 
-	return &storage{webAPI: webAPI, candidateID: fastNodeID, userID: vipInfo.UserID, groupID: cfg.GroupID}, nil
+	sessionDir := cfg.SessionDir
+	if len(sessionDir) == 0 {
+		sessionDir = filepath.Join(os.TempDir(), "titan-upload-sessions")
+	}
+
+	return &storage{webAPI: webAPI, nodeClient: nodeClient, externalClient: externalClient, nodeMiddlewares: cfg.NodeMiddlewares, candidateID: fastNodeID, userID: vipInfo.UserID, groupID: cfg.GroupID, sessionDir: sessionDir, keyProvider: cfg.KeyProvider, downloadTransport: cfg.DownloadTransport, downloadBufferBudget: cfg.DownloadBufferBudget, downloadMemoryBuffer: cfg.DownloadMemoryBuffer}, nil
 }
 
 // or you can use the global value TitanAreas after call Initliaze.
@@ -343,18 +539,55 @@ func (s *storage) UploadAssetWithUrl(ctx context.Context, url string) (cid.Cid,
 	return cid.Cid{}, "", errors.New("not implemented yet")
 }
 
+// newRange returns the ranged downloader of an asset
+func (s *storage) newRange() *byterange.Range {
+	var options []byterange.Option
+	if s.downloadTransport != nil {
+		options = append(options, byterange.WithTransport(s.downloadTransport))
+	}
+	if len(s.nodeMiddlewares) > 0 {
+		options = append(options, byterange.WithMiddleware(s.nodeMiddlewares...))
+	}
+	if s.downloadBufferBudget > 0 {
+		options = append(options, byterange.WithBufferBudget(s.downloadBufferBudget))
+	}
+	if s.downloadMemoryBuffer {
+		options = append(options, byterange.WithMemoryBuffer())
+	}
+	return byterange.New(1<<20, 3, options...)
+}
+
 // DownloadAsset Download files/folders
-func (s *storage) DownloadAsset(ctx context.Context, assetCID string) (io.ReadCloser, string, error) {
+func (s *storage) DownloadAsset(ctx context.Context, assetCID string, options ...DownloadOption) (io.ReadCloser, string, error) {
+	opts := newDownloadOptions(options)
+	if opts.car {
+		return s.downloadCarFile(ctx, assetCID)
+	}
+
 	res, err := s.GetURL(ctx, assetCID)
 	if err != nil {
 		return nil, "", err
 	}
 
+	if err := s.checkDecryptable(assetCID, res); err != nil {
+		return nil, "", err
+	}
+
 	start := time.Now()
 
-	r := byterange.New(1<<20, 3)
+	r := s.newRange()
 
 	reader, progress, err := r.GetFile(ctx, res.Copy2RangeFileReq())
+	if err == nil {
+		reader, err = verifyDownload(assetCID, reader, opts)
+	}
+	if err == nil {
+		reader, err = s.decryptDownload(ctx, res.Encrypted, reader)
+	}
+	if err == nil {
+		stop := watchDownload(progress().Stats, opts.progress)
+		reader = &statsReader{ReadCloser: reader, stats: progress().Stats, stop: stop}
+	}
 
 	report := &client.AssetTransferReq{
 		CostMs:       int64(time.Since(start).Milliseconds()),
@@ -414,13 +647,13 @@ func getFileType(filePath string) (string, error) {
 	return string(fileType), nil
 }
 
-// errAssetNotExist returns an error indicating that the asset does not exist
+// errAssetNotExist returns an error indicating that the asset does not exist, it matches client.ErrAssetNotFound
 func errAssetNotExist(cid string) error {
-	return fmt.Errorf("ShareAssets err:asset %s not exist", cid)
+	return fmt.Errorf("ShareAssets err:asset %s not exist: %w", cid, client.ErrAssetNotFound)
 }
 
 // getFastNodes returns a list of fast nodes from the given candidates
-func getFastNodes(candidates []*client.CandidateIPInfo) []*client.CandidateIPInfo {
+func getFastNodes(httpClient *http.Client, candidates []*client.CandidateIPInfo) []*client.CandidateIPInfo {
 	if len(candidates) == 0 {
 		return make([]*client.CandidateIPInfo, 0)
 	}
@@ -439,9 +672,7 @@ func getFastNodes(candidates []*client.CandidateIPInfo) []*client.CandidateIPInf
 		}
 		request = request.WithContext(ctx)
 
-		// Create an HTTP client and send the request
-		client := http.DefaultClient
-		_, err = client.Do(request)
+		_, err = httpClient.Do(request)
 		if err != nil {
 			return fmt.Errorf("do error %s", err.Error())
 		}
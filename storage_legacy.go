@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,41 +18,25 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/utopiosphe/titan-storage-sdk/client"
-	"github.com/utopiosphe/titan-storage-sdk/memfile"
-	byterange "github.com/utopiosphe/titan-storage-sdk/range"
 )
 
 // uploadFileWithForm uploads a file using a multipart form
-func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, name, uploadURL, token, trace_id string, progress ProgressFunc) (*UploadFileResult, error) {
-	// Create a new multipart form body
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Create a new form field for the file
-	fileField, err := writer.CreateFormFile("file", name)
-	if err != nil {
-		return nil, err
-	}
-
-	// Copy the file data to the form field
-	_, err = io.Copy(fileField, r)
+// The form is streamed as the envelope prefix, the content of r and the envelope suffix,
+// size is the size of the content of r and lets the request carry a Content-Length.
+func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, size int64, name, uploadURL, token, trace_id string, progress ProgressFunc) (*UploadFileResult, error) {
+	contentType, prefix, suffix, err := multipartEnvelope("file", name)
 	if err != nil {
 		return nil, err
 	}
 
-	// Close the multipart form
-	err = writer.Close()
-	if err != nil {
-		return nil, err
-	}
-
-	totalSize := body.Len()
+	totalSize := size
+	bodySize := int64(len(prefix)) + size + int64(len(suffix))
 	dongSize := int64(0)
-	pr := &ProgressReader{body, func(r int64) {
+	pr := &ProgressReader{io.MultiReader(bytes.NewReader(prefix), r, bytes.NewReader(suffix)), func(r int64) {
 		if r > 0 {
 			dongSize += r
 			if progress != nil {
-				progress(dongSize, int64(totalSize))
+				progress(dongSize, bodySize)
 			}
 		}
 	}}
@@ -61,18 +46,17 @@ func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, name, upl
 	if err != nil {
 		return nil, fmt.Errorf("new request error %s", err.Error())
 	}
+	request.ContentLength = bodySize
 
-	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("Content-Type", contentType)
 	request.Header.Set("Authorization", "Bearer "+token)
 	request = request.WithContext(ctx)
 
 	start := time.Now()
 
-	// Create an HTTP client and send the request
-	httpClient := http.DefaultClient
-	response, err := httpClient.Do(request)
+	response, err := s.getNodeClient().Do(request)
 	if err != nil {
-		return nil, fmt.Errorf("do error %s", err.Error())
+		return nil, fmt.Errorf("do error %w", err)
 	}
 	defer response.Body.Close()
 
@@ -88,7 +72,7 @@ func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, name, upl
 
 	report := &client.AssetTransferReq{
 		CostMs:       int64(time.Since(start).Milliseconds()),
-		TotalSize:    int64(totalSize),
+		TotalSize:    totalSize,
 		TransferType: client.AssetTransferTypeUpload,
 		State:        client.AssetTransferStateFailed,
 		TraceID:      trace_id,
@@ -111,7 +95,7 @@ func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, name, upl
 		return nil, fmt.Errorf(ret.Msg)
 	}
 
-	ret.totalSize = int64(totalSize)
+	ret.totalSize = totalSize
 
 	report.Cid = ret.Cid
 	report.State = client.AssetTransferStateSuccess
@@ -119,8 +103,32 @@ func (s *storage) uploadFileWithForm(ctx context.Context, r io.Reader, name, upl
 	return &ret, nil
 }
 
+// multipartEnvelope returns the content type of a multipart form with a single file field,
+// and the bytes written before and after the content of the file
+func multipartEnvelope(fieldName, fileName string) (string, []byte, []byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	if _, err := writer.CreateFormFile(fieldName, fileName); err != nil {
+		return "", nil, nil, err
+	}
+	prefixSize := buf.Len()
+
+	if err := writer.Close(); err != nil {
+		return "", nil, nil, err
+	}
+
+	envelope := buf.Bytes()
+	return writer.FormDataContentType(), envelope[:prefixSize], envelope[prefixSize:], nil
+}
+
 // return root, subs, error
 func (s *storage) uploadFilesWithPathAndMakeCar(ctx context.Context, filePath string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
+	opts := newRequestOptions(client.AssetProperty{NodeID: s.candidateID, GroupID: s.groupID}, options)
+	if opts.Encrypted {
+		return s.uploadEncryptedFile(ctx, filePath, progress, options...)
+	}
+
 	// delete template file if exist
 	fileName := filepath.Base(filePath)
 	tempFile := path.Join(os.TempDir(), fileName)
@@ -128,7 +136,7 @@ func (s *storage) uploadFilesWithPathAndMakeCar(ctx context.Context, filePath st
 		os.Remove(tempFile)
 	}
 
-	root, err := createCar(filePath, tempFile)
+	root, err := createCar(filePath, tempFile, opts.dag)
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -158,94 +166,37 @@ func (s *storage) uploadFilesWithPathAndMakeCar(ctx context.Context, filePath st
 		return cid.Cid{}, err
 	}
 
-	assetProperty := client.AssetProperty{
-		AssetCID:  root.String(),
-		AssetName: fileName,
-		AssetSize: fileInfo.Size(),
-		AssetType: fileType,
-		NodeID:    s.candidateID,
-		GroupID:   s.groupID,
-	}
-
-	for _, opt := range options {
-		opt(&assetProperty)
-	}
-
-	req := client.CreateAssetReq{AssetProperty: assetProperty, AreaIDs: s.areas}
-	rsp, err := s.webAPI.CreateAsset(ctx, &req)
-	if err != nil {
-		return cid.Cid{}, fmt.Errorf("CreateAsset error %w", err)
-	}
+	opts.AssetCID = root.String()
+	opts.AssetName = fileName
+	opts.AssetSize = fileInfo.Size()
+	opts.AssetType = fileType
 
-	if rsp.IsAlreadyExist {
-		return root, nil
-	}
-
-	if len(rsp.Endpoints) == 0 {
-		return cid.Cid{}, fmt.Errorf("endpoints is empty")
-	}
-
-	var (
-		report = &client.AssetTransferReq{
-			// CostMs:       int64(time.Since(start).Milliseconds()),
-			TotalSize:    assetProperty.AssetSize,
-			TransferType: client.AssetTransferTypeUpload,
-			Cid:          root.String(),
-			State:        client.AssetTransferStateFailed,
-		}
-		logContent = make(map[string]string)
-		// final      bool
-	)
-
-	defer func(r *client.AssetTransferReq) {
-		if err := s.webAPI.AssetTransferReport(context.Background(), *r); err != nil {
-			log.Printf("failed to send transfer report, %s", err.Error())
-		}
-	}(report)
-
-	for _, ep := range rsp.Endpoints {
-
-		nodeid := getNodeIdFromCandidateAddr(ep.CandidateAddr)
-		report.TraceID = ep.TraceID
-		// if upload succeed,
-		report.NodeID = joinNodeID(report.NodeID, nodeid)
-
-		start := time.Now()
-		_, err = s.uploadFileWithForm(ctx, carFile, fileName, ep.CandidateAddr, ep.Token, ep.TraceID, progress)
-		report.CostMs = int64(time.Since(start).Milliseconds())
-
-		if err == nil {
-			report.State = client.AssetTransferStateSuccess
-			return root, nil
-		} else {
-			fmt.Printf("upload req: %+v\n", ep)
-			logContent[nodeid] = err.Error()
-			// go func(r *client.AssetTransferReq) {
-			// 	if err := s.webAPI.AssetTransferReport(context.Background(), *r); err != nil {
-			// 		log.Printf("failed to send transfer report, %s", err.Error())
-			// 	}
-			// }(report)
-
-			if delErr := s.webAPI.DeleteAsset(ctx, s.userID, root.String()); delErr != nil {
-				return cid.Cid{}, fmt.Errorf("uploadFileWithForm failed %s, delete error %s", err.Error(), delErr.Error())
-			}
-			// return cid.Cid{}, fmt.Errorf("uploadFileWithForm error %s, delete it from titan", err.Error())
-		}
-
-	}
-
-	return cid.Cid{}, fmt.Errorf("upload file failed")
+	return s.registerAndUpload(ctx, root, opts, func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(carFile, 0, fileInfo.Size())), nil
+	}, progress)
 }
 
 // FetchBlockFromRoot fetch single block from rootCID
 // It returns the block and any error encountered.
-func (s *storage) FetchBlockFromRoot(ctx context.Context, rootCid, subCid string) (io.ReadCloser, error) {
+// WithVerification checks the block against subCid, a block that does not match is fetched from the next node.
+func (s *storage) FetchBlockFromRoot(ctx context.Context, rootCid, subCid string, options ...DownloadOption) (io.ReadCloser, error) {
+	opts := newDownloadOptions(options)
+
+	var block cid.Cid
+	if opts.verify {
+		var err error
+		if block, err = cid.Decode(subCid); err != nil {
+			return nil, err
+		}
+	}
 
 	res, err := s.webAPI.ShareAsset(ctx, s.userID, "", rootCid, false)
 	if err != nil {
 		return nil, err
 	}
 
+	var integrityErr error
+
 	if len(res.URLs) > 0 {
 		for _, v := range res.URLs {
 			// https://<node-id-address>/ipfs/<YOUR-CID-HERE>?token=<YOUR-TOKEN>&filename=<YOUR-FILENAME>
@@ -270,21 +221,37 @@ func (s *storage) FetchBlockFromRoot(ctx context.Context, rootCid, subCid string
 				continue
 			}
 
-			resp, err := http.DefaultClient.Do(req)
+			resp, err := s.getNodeClient().Do(req)
 			if err != nil {
 				log.Printf("do request error %s", err.Error())
 				continue
 			}
 
 			if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+				resp.Body.Close()
 				log.Printf("http StatusCode %d", resp.StatusCode)
 				continue
 			}
 
-			return resp.Body, nil
+			if !opts.verify {
+				return resp.Body, nil
+			}
+
+			rc, err := readBlock(block, resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				log.Printf("read block %s from %s error %s", subCid, u.Host, err.Error())
+				integrityErr = err
+				continue
+			}
+			return rc, nil
 		}
 	}
 
+	if integrityErr != nil {
+		return nil, integrityErr
+	}
+
 	return nil, fmt.Errorf("get subcid failed")
 }
 
@@ -319,7 +286,7 @@ func (s *storage) ListAllBlocks(ctx context.Context, rootCid string) ([]string,
 				continue
 			}
 
-			resp, err := http.DefaultClient.Do(req)
+			resp, err := s.getNodeClient().Do(req)
 			if err != nil {
 				log.Printf("do request error %s", err.Error())
 				continue
@@ -361,11 +328,31 @@ func (s *storage) ListAllBlocks(ctx context.Context, rootCid string) ([]string,
 
 // UploadFilesWithPath uploads files from the specified path
 func (s *storage) UploadFilesWithPath(ctx context.Context, filePath string, progress ProgressFunc, makeCar bool, options ...RequestOption) (cid.Cid, error) {
-	if makeCar {
-		return s.uploadFilesWithPathAndMakeCar(ctx, filePath, progress)
+	opts := newRequestOptions(client.AssetProperty{GroupID: s.groupID}, options)
+
+	// the node builds the dag with its own options, so the car is made locally
+	if makeCar || opts.dag != nil {
+		return s.uploadFilesWithPathAndMakeCar(ctx, filePath, progress, options...)
 	}
 
-	rsp, err := s.webAPI.GetNodeUploadInfo(ctx, s.userID, s.getArea(), false)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	if root, skip, err := s.dedupContent(ctx, opts, io.NewSectionReader(f, 0, fileInfo.Size()), fileInfo.Name(), fileInfo.Size()); err != nil {
+		return cid.Cid{}, err
+	} else if skip {
+		return root, nil
+	}
+
+	rsp, err := s.getNodeUploadInfo(ctx, false, opts.Encrypted)
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -378,15 +365,22 @@ func (s *storage) UploadFilesWithPath(ctx context.Context, filePath string, prog
 		return cid.Cid{}, fmt.Errorf("endpoints is empty")
 	}
 
-	f, err := os.Open(filePath)
+	node := rsp.List[0]
+
+	var (
+		content io.Reader = f
+		size              = fileInfo.Size()
+	)
+
+	enc, err := s.encryptor(ctx, opts, fileInfo.Size())
 	if err != nil {
 		return cid.Cid{}, err
 	}
-	defer f.Close()
-
-	node := rsp.List[0]
+	if enc != nil {
+		content, size = enc.Reader(f), enc.encryptedSize()
+	}
 
-	ret, err := s.uploadFileWithForm(ctx, f, f.Name(), node.UploadURL, node.Token, rsp.TraceID, progress)
+	ret, err := s.uploadFileWithForm(ctx, content, size, f.Name(), node.UploadURL, node.Token, rsp.TraceID, progress)
 	if err != nil {
 		return cid.Cid{}, fmt.Errorf("upload file with form failed, %s", err.Error())
 	}
@@ -405,27 +399,13 @@ func (s *storage) UploadFilesWithPath(ctx context.Context, filePath string, prog
 		return cid.Cid{}, err
 	}
 
-	fileInfo, err := f.Stat()
-	if err != nil {
-		return cid.Cid{}, err
-	}
-
-	fmt.Printf("f name %s, fileInfo name %s", f.Name(), fileInfo.Name())
-
-	assetProperty := client.AssetProperty{
-		AssetCID:  ret.Cid,
-		AssetName: fileInfo.Name(),
-		AssetSize: fileInfo.Size(),
-		AssetType: fileType,
-		NodeID:    node.NodeID,
-		GroupID:   s.groupID,
-	}
+	opts.AssetCID = ret.Cid
+	opts.AssetName = fileInfo.Name()
+	opts.AssetSize = size
+	opts.AssetType = fileType
+	opts.NodeID = node.NodeID
 
-	for _, opt := range options {
-		opt(&assetProperty)
-	}
-
-	req := client.CreateAssetReq{AssetProperty: assetProperty, AreaIDs: s.areas}
+	req := client.CreateAssetReq{AssetProperty: opts.AssetProperty, AreaIDs: s.areas}
 	_, err = s.webAPI.CreateAsset(context.Background(), &req)
 	if err != nil {
 		return cid.Cid{}, fmt.Errorf("CreateAsset error %w", err)
@@ -441,69 +421,104 @@ func (s *storage) Delete(ctx context.Context, rootCID string) error {
 }
 
 // UploadStream uploads a stream of data
+// The car is made in two passes over the stream: the first pass computes the root and the car size
+// without keeping any block, the second pass streams the car straight into the upload body.
+// Streams without random access are spooled to a temporary file, so memory stays bounded.
 func (s *storage) UploadStream(ctx context.Context, r io.Reader, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
-	memFile := memfile.New([]byte{})
-	root, err := createCarStream(r, memFile)
+	opts := newRequestOptions(client.AssetProperty{NodeID: s.candidateID, GroupID: s.groupID}, options)
+
+	source, err := newReplayableSource(r)
 	if err != nil {
 		return cid.Cid{}, err
 	}
-	memFile.Seek(0, 0)
+	defer source.Close()
 
-	if len(name) == 0 {
-		name = root.String()
+	var content contentSource = source
+
+	// the car is made of the encrypted content
+	enc, err := s.encryptor(ctx, opts, source.Size())
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if enc != nil {
+		content = &encryptedSource{source: source, c: enc}
 	}
 
-	assetProperty := client.AssetProperty{
-		AssetCID:  root.String(),
-		AssetName: name,
-		AssetSize: int64(len(memFile.Bytes())),
-		AssetType: string(FileTypeFile),
-		NodeID:    s.candidateID,
-		GroupID:   s.groupID,
+	root, carSize, err := calculateCarV1(content.Open(), opts.dag)
+	if err != nil {
+		return cid.Cid{}, err
 	}
 
-	for _, opt := range options {
-		opt(&assetProperty)
+	if len(name) == 0 {
+		name = root.String()
 	}
 
-	req := client.CreateAssetReq{AssetProperty: assetProperty, AreaIDs: s.areas}
-	rsp, err := s.webAPI.CreateAsset(ctx, &req)
+	opts.AssetCID = root.String()
+	opts.AssetName = name
+	opts.AssetSize = carSize
+	opts.AssetType = string(FileTypeFile)
+
+	endpoints, err := s.registerAsset(ctx, opts)
 	if err != nil {
-		return cid.Cid{}, fmt.Errorf("CreateAsset error %w", err)
-	}
-	// fmt.Printf("CreateAsset rsp %+v\n", rsp)
-	// for i, v := range rsp.Endpoints {
-	// 	fmt.Printf("endpoint[%d] %+v\n", i, v)
-	// }
-	if rsp.IsAlreadyExist {
+		return cid.Cid{}, err
+	} else if len(endpoints) == 0 {
 		return root, nil
 	}
 
-	c := len(rsp.Endpoints)
-	for i, ep := range rsp.Endpoints {
-		_, err = s.uploadFileWithForm(ctx, memFile, root.String(), ep.CandidateAddr, ep.Token, ep.TraceID, progress)
-		if err != nil {
-			// fmt.Printf("upload req: %+v\n", ep)
-			// return cid.Cid{}, fmt.Errorf("uploadFileWithForm error %s, delete it from titan", err.Error())
-			log.Printf("uploadFileWithForm error %s, delete it from titan\n", err.Error())
-		}
-		if err != nil && i+1 == c {
-			if delErr := s.webAPI.DeleteAsset(ctx, s.userID, root.String()); delErr != nil {
-				return cid.Cid{}, fmt.Errorf("uploadFileWithForm failed %s, delete error %s", err.Error(), delErr.Error())
-			}
-			return cid.Cid{}, err
-		}
-		if err == nil {
-			return root, nil
+	u := &replicaUpload{
+		root: root,
+		name: root.String(),
+		size: carSize,
+		// every replica reads its own car, generated while it is read
+		open: func() (io.ReadCloser, error) {
+			return streamCar(content, root, opts.dag), nil
+		},
+		replicas: opts.replicas,
+		quorum:   opts.quorum,
+	}
+
+	if _, err = s.uploadReplicas(ctx, endpoints, u, progress); err != nil {
+		log.Printf("uploadFileWithForm error %s, delete it from titan\n", err.Error())
+		if delErr := s.webAPI.DeleteAsset(ctx, s.userID, root.String()); delErr != nil {
+			return cid.Cid{}, fmt.Errorf("uploadFileWithForm failed %s, delete error %s", err.Error(), delErr.Error())
 		}
+		return cid.Cid{}, err
 	}
 
-	return cid.Cid{}, fmt.Errorf("upload file failed")
+	return root, nil
+}
+
+// streamCar returns a reader of the CARv1 of source, the car is generated while it is read
+func streamCar(source contentSource, root cid.Cid, dag *DagOptions) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeCarV1(source.Open(), root, pw, dag))
+	}()
+	return pr
 }
 
 // UploadStreamV2 uploads data from an io.Reader stream without making car to the titan storage.
 func (s *storage) UploadStreamV2(ctx context.Context, r io.Reader, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
-	rsp, err := s.webAPI.GetNodeUploadInfo(ctx, s.userID, s.getArea(), false)
+	opts := newRequestOptions(client.AssetProperty{GroupID: s.groupID}, options)
+
+	// the node builds the dag with its own options, so the car is made locally
+	if opts.dag != nil {
+		return s.UploadStream(ctx, r, name, progress, options...)
+	}
+
+	source, err := newReplayableSource(r)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer source.Close()
+
+	if root, skip, err := s.dedupContent(ctx, opts, source.Open(), name, source.Size()); err != nil {
+		return cid.Cid{}, err
+	} else if skip {
+		return root, nil
+	}
+
+	rsp, err := s.getNodeUploadInfo(ctx, false, opts.Encrypted)
 	if err != nil {
 		return cid.Cid{}, err
 	}
@@ -563,17 +578,20 @@ func (s *storage) UploadStreamV2(ctx context.Context, r io.Reader, name string,
 		nodeId string
 	)
 
-	body := &bytes.Buffer{}
-	writer := io.MultiWriter(body)
-	io.Copy(writer, r)
-	cnt := body.Bytes()
+	var content contentSource = source
+
+	enc, err := s.encryptor(ctx, opts, source.Size())
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if enc != nil {
+		content = &encryptedSource{source: source, c: enc}
+	}
 
 	for _, node := range rsp.List {
 		nodeId = node.NodeID
 
-		nr := bytes.NewReader(cnt)
-
-		ret, err = s.uploadFileWithForm(ctx, nr, name, node.UploadURL, node.Token, rsp.TraceID, progress)
+		ret, err = s.uploadFileWithForm(ctx, content.Open(), content.Size(), name, node.UploadURL, node.Token, rsp.TraceID, progress)
 		if err != nil {
 			err = fmt.Errorf("upload file with form failed, error: %s", err.Error())
 			log.Println(err)
@@ -612,20 +630,13 @@ func (s *storage) UploadStreamV2(ctx context.Context, r io.Reader, name string,
 
 	log.Printf("f name %s, fileType name %s \n", name, "file")
 
-	assetProperty := client.AssetProperty{
-		AssetCID:  ret.Cid,
-		AssetName: name,
-		AssetSize: ret.totalSize,
-		AssetType: "file",
-		NodeID:    nodeId,
-		GroupID:   s.groupID,
-	}
-
-	for _, opt := range options {
-		opt(&assetProperty)
-	}
+	opts.AssetCID = ret.Cid
+	opts.AssetName = name
+	opts.AssetSize = ret.totalSize
+	opts.AssetType = "file"
+	opts.NodeID = nodeId
 
-	req := client.CreateAssetReq{AssetProperty: assetProperty, AreaIDs: s.areas}
+	req := client.CreateAssetReq{AssetProperty: opts.AssetProperty, AreaIDs: s.areas}
 	_, err = s.webAPI.CreateAsset(context.Background(), &req)
 	if err != nil {
 		return cid.Cid{}, fmt.Errorf("CreateAsset error %w", err)
@@ -636,17 +647,36 @@ func (s *storage) UploadStreamV2(ctx context.Context, r io.Reader, name string,
 }
 
 // GetFileWithCid gets a single file by rootCID
-func (s *storage) GetFileWithCid(ctx context.Context, rootCID string) (io.ReadCloser, string, error) {
+func (s *storage) GetFileWithCid(ctx context.Context, rootCID string, options ...DownloadOption) (io.ReadCloser, string, error) {
+	opts := newDownloadOptions(options)
+	if opts.car {
+		return s.downloadCarFile(ctx, rootCID)
+	}
+
 	res, err := s.GetURL(ctx, rootCID)
 	if err != nil {
 		return nil, "", err
 	}
 
+	if err := s.checkDecryptable(rootCID, res); err != nil {
+		return nil, "", err
+	}
+
 	start := time.Now()
 
-	r := byterange.New(1<<20, 3)
+	r := s.newRange()
 
 	reader, progress, err := r.GetFile(ctx, res.Copy2RangeFileReq())
+	if err == nil {
+		reader, err = verifyDownload(rootCID, reader, opts)
+	}
+	if err == nil {
+		reader, err = s.decryptDownload(ctx, res.Encrypted, reader)
+	}
+	if err == nil {
+		stop := watchDownload(progress().Stats, opts.progress)
+		reader = &statsReader{ReadCloser: reader, stats: progress().Stats, stop: stop}
+	}
 
 	report := &client.AssetTransferReq{
 		CostMs:       int64(time.Since(start).Milliseconds()),
@@ -784,15 +814,16 @@ func (s *storage) GetURL(ctx context.Context, rootCID string) (*client.ShareAsse
 		time.Sleep(interval)
 
 		if time.Since(startTime) > timeout {
-			return nil, fmt.Errorf("time out of %ds, can not find asset exist", timeout/time.Second)
+			return nil, fmt.Errorf("time out of %ds, %w", timeout/time.Second, errAssetNotExist(rootCID))
 		}
 
 		result, err := s.webAPI.ShareAsset(ctx, s.userID, "", rootCID, true)
 		if err != nil {
 			log.Printf("ShareUserAsset %v, cid: %s \n", err.Error(), rootCID)
-			// if err.Error() != errAssetNotExist(rootCID).Error() {
-			// 	return nil, fmt.Errorf("ShareUserAssets %w", err)
-			// }
+			// the asset may not be shareable yet, the other failures will not go away
+			if errors.Is(err, client.ErrUnauthorized) || errors.Is(err, client.ErrQuotaExceeded) {
+				return nil, fmt.Errorf("ShareUserAssets %w", err)
+			}
 			continue
 		}
 
@@ -816,7 +847,11 @@ func (s *storage) GetURL(ctx context.Context, rootCID string) (*client.ShareAsse
 // UploadFileWithURL uploads a file from the specified URL
 func (s *storage) UploadFileWithURL(ctx context.Context, url string, progress ProgressFunc, options ...RequestOption) (string, string, error) {
 	log.Println("UploadFileWithURL link:", url)
-	rsp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	rsp, err := s.getExternalClient().Do(req)
 	if err != nil {
 		log.Printf("http.Get(%s) error: %s \n", url, err)
 		return "", "", err
@@ -900,6 +935,36 @@ func (s *storage) getArea() string {
 	return ""
 }
 
+// getNodeUploadInfo returns the nodes of an upload, an encrypted one needs a Webserver implementing client.UploadInfoGetter
+func (s *storage) getNodeUploadInfo(ctx context.Context, urlMode, encrypted bool) (*client.UploadInfo, error) {
+	if !encrypted {
+		return s.webAPI.GetNodeUploadInfo(ctx, s.userID, s.getArea(), urlMode)
+	}
+
+	getter, ok := s.webAPI.(client.UploadInfoGetter)
+	if !ok {
+		return nil, fmt.Errorf("the web API client does not support encrypted uploads")
+	}
+	return getter.GetNodeUploadInfoWithOptions(ctx, s.userID, client.UploadInfoOptions{Area: s.getArea(), URLMode: urlMode, Encrypted: true})
+}
+
+// getNodeClient returns the client of the requests to the nodes, http.DefaultClient if none is set
+func (s *storage) getNodeClient() *http.Client {
+	if s.nodeClient == nil {
+		return http.DefaultClient
+	}
+	return s.nodeClient
+}
+
+// getExternalClient returns the client of the URLs given by the caller, http.DefaultClient if none is set.
+// It carries no middleware, so nothing meant for the web API or the nodes reaches a foreign host.
+func (s *storage) getExternalClient() *http.Client {
+	if s.externalClient == nil {
+		return http.DefaultClient
+	}
+	return s.externalClient
+}
+
 // WithGroupID update file folder's id
 func WithGroupID(id int) RequestOption {
 	return func(ap *client.AssetProperty) {
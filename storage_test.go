@@ -1,14 +1,20 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/ipld/go-car/v2"
+	"github.com/utopiosphe/titan-storage-sdk/client"
 	"github.com/utopiosphe/titan-storage-sdk/memfile"
 )
 
@@ -35,9 +41,9 @@ func TestCalculateCarCID(t *testing.T) {
 func TestCreateCarWithFile(t *testing.T) {
 
 	input := "xx.zip"
-	output := "./xx.car"
+	output := filepath.Join(t.TempDir(), "xx.car")
 
-	root, err := createCar(input, output)
+	root, err := createCar(input, output, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,7 +60,7 @@ func TestCreateCarWithStream(t *testing.T) {
 	defer f.Close()
 
 	mFile := memfile.New([]byte{})
-	root, err := createCarStream(f, mFile)
+	root, err := createCarStream(f, mFile, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -289,3 +295,191 @@ func TestUploadCarFetchBlock(t *testing.T) {
 	t.Logf("content size %d", len(content))
 	t.Log("content ", string(content))
 }
+
+func TestStreamCarMatchesCalculateCid(t *testing.T) {
+	content := bytes.Repeat([]byte("titan storage "), 1<<16)
+
+	root, size, err := calculateCarV1(bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect, err := CalculateCid(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.Equals(expect) {
+		t.Fatalf("root %s, expect %s", root, expect)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCarV1(bytes.NewReader(content), root, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) != size {
+		t.Fatalf("car size %d, expect %d", buf.Len(), size)
+	}
+
+	br, err := car.NewBlockReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(br.Roots) != 1 || !br.Roots[0].Equals(root) {
+		t.Fatalf("unexpected roots %v", br.Roots)
+	}
+	for {
+		if _, err := br.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeCarV1(bytes.NewReader(content[1:]), root, io.Discard, nil); err == nil {
+		t.Fatal("expect an error when the content changes between passes")
+	}
+}
+
+func TestUploadStreamWithoutSeek(t *testing.T) {
+	var uploads [][]byte
+	failing := newUploadServer(t, http.StatusBadGateway, nil)
+	working := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: failing.URL}, {CandidateAddr: working.URL}}}
+	s := &storage{webAPI: web}
+
+	content := bytes.Repeat([]byte("stream"), 1<<16)
+	// MultiReader hides the random access of bytes.Reader, so the stream is spooled
+	root, err := s.UploadStream(context.Background(), io.MultiReader(bytes.NewReader(content)), "", nil)
+	if err != nil {
+		t.Fatal("UploadStream ", err)
+	}
+
+	if len(web.created) != 1 || web.created[0].AssetName != root.String() {
+		t.Fatalf("unexpected create asset requests %+v", web.created)
+	}
+	if len(uploads) != 1 || int64(len(uploads[0])) != web.created[0].AssetSize {
+		t.Fatalf("uploaded car does not match the registered size")
+	}
+
+	br, err := car.NewBlockReader(bytes.NewReader(uploads[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !br.Roots[0].Equals(root) {
+		t.Fatalf("car root %s, expect %s", br.Roots[0], root)
+	}
+}
+
+func TestUploadFileWithFormContentLength(t *testing.T) {
+	content := bytes.Repeat([]byte("form"), 1<<18)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) != 0 || r.ContentLength <= int64(len(content)) {
+			t.Errorf("expect a content length, got %d, %v", r.ContentLength, r.TransferEncoding)
+		}
+
+		// the short reader case is aborted by the client while the body is sent
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		if header.Filename != "form.bin" || !bytes.Equal(b, content) {
+			t.Errorf("unexpected form file %s of %d bytes", header.Filename, len(b))
+		}
+		fmt.Fprint(w, `{"code":0,"cid":"bafkreibcyimvlzbgwudx3oict7iufabktjherbhkopwaxzobukpc2bricq"}`)
+	}))
+	defer srv.Close()
+
+	s := &storage{webAPI: &fakeWebserver{}}
+
+	var done, total int64
+	ret, err := s.uploadFileWithForm(context.Background(), bytes.NewReader(content), int64(len(content)), "form.bin", srv.URL, "", "", func(doneSize, totalSize int64) {
+		done, total = doneSize, totalSize
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ret.totalSize != int64(len(content)) {
+		t.Fatalf("total size %d, expect %d", ret.totalSize, len(content))
+	}
+	if done != total || total <= int64(len(content)) {
+		t.Fatalf("progress should reach the body size, %d of %d", done, total)
+	}
+
+	// a short reader must not be sent with a wrong content length
+	if _, err := s.uploadFileWithForm(context.Background(), bytes.NewReader(content[1:]), int64(len(content)), "form.bin", srv.URL, "", "", nil); err == nil {
+		t.Fatal("expect an error when the reader is shorter than size")
+	}
+}
+
+func TestInitializeSeparatesClients(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Secret") != "secret" {
+			t.Errorf("web API call %s without its middleware", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"code":0,"data":{}}`)
+	}))
+	defer api.Close()
+
+	var nodeRequests int
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nodeRequests++
+		if r.Header.Get("X-Api-Secret") != "" {
+			t.Errorf("credential of the web API sent to %s", r.URL.Path)
+		}
+		if r.URL.Path == "/node" && r.Header.Get("User-Agent") != "sdk" {
+			t.Error("node request without the node middleware")
+		}
+		if r.URL.Path == "/external" && r.Header.Get("User-Agent") == "sdk" {
+			t.Error("node middleware applied to an external URL")
+		}
+	}))
+	defer node.Close()
+
+	s, err := Initialize(&Config{
+		TitanURL:        api.URL,
+		APIKey:          "key",
+		HTTPClient:      &http.Client{Timeout: time.Minute},
+		Middlewares:     []client.Middleware{client.SetHeader("X-Api-Secret", "secret")},
+		NodeMiddlewares: []client.Middleware{client.UserAgent("sdk")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.(*storage)
+
+	if st.getNodeClient().Timeout != 0 || st.getExternalClient().Timeout != 0 {
+		t.Fatal("the timeout of the web API applies to the nodes")
+	}
+	for client, path := range map[*http.Client]string{st.getNodeClient(): "/node", st.getExternalClient(): "/external"} {
+		rsp, err := client.Get(node.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+	}
+	if nodeRequests != 2 {
+		t.Fatalf("got %d node requests, expected 2", nodeRequests)
+	}
+}
+
+func TestInitializeDownloadBuffer(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"code":0,"data":{}}`)
+	}))
+	defer api.Close()
+
+	s, err := Initialize(&Config{TitanURL: api.URL, APIKey: "key", DownloadBufferBudget: 8 << 20, DownloadMemoryBuffer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := s.(*storage)
+	if st.downloadBufferBudget != 8<<20 || !st.downloadMemoryBuffer {
+		t.Fatalf("download buffer not set, budget %d, memory %v", st.downloadBufferBudget, st.downloadMemoryBuffer)
+	}
+}
@@ -38,18 +38,38 @@ type tenant struct {
 	client    *http.Client
 }
 
-func NewTenant(titanUrl, tenantKey string) (Tenant, error) {
+// NewTenant creates a new Tenant instance, options set the HTTP client, transport or middlewares of its requests.
+// The tenant is authenticated with its key and its calls are not retried,
+// so client.WithTokenSource and client.WithRetryPolicy are rejected.
+func NewTenant(titanUrl, tenantKey string, options ...client.Option) (Tenant, error) {
 	if len(titanUrl) == 0 || len(tenantKey) == 0 {
 		return nil, fmt.Errorf("TitanURL or APIKey can not empty")
 	}
 
+	cfg := client.NewHTTPConfig(options...)
+	if cfg.TokenSource != nil {
+		return nil, fmt.Errorf("tenant requests are authenticated with the tenant key, a token source is not supported")
+	}
+	if cfg.Retry != nil {
+		return nil, fmt.Errorf("tenant requests are not retried, a retry policy is not supported")
+	}
+
 	return &tenant{
 		titanUrl:  titanUrl,
 		tenantKey: tenantKey,
-		client:    http.DefaultClient,
+		client:    cfg.NewClient(),
 	}, nil
 }
 
+// do sends request and returns its result, a *client.APIError if the call failed
+func (t *tenant) do(request *http.Request) (*client.Result, error) {
+	rsp, err := t.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadResult(rsp)
+}
+
 type SubUserInfo struct {
 	EntryUUID string `json:"entry_uuid"`
 	Username  string `json:"username"`
@@ -59,7 +79,29 @@ type SubUserInfo struct {
 
 type SSOLoginRsp struct {
 	Token string `json:"token"`
-	Exp   int64  `json:"exp"`
+	// Exp is the unix time the token expires
+	Exp int64 `json:"exp"`
+}
+
+// token returns the token of the login with its expiry
+func (r *SSOLoginRsp) token() client.Token {
+	token := client.Token{Value: r.Token}
+	if r.Exp > 0 {
+		token.Expiry = time.Unix(r.Exp, 0)
+	}
+	return token
+}
+
+// TenantTokenSource returns the tokens of a sub account user, starting from login, the response of SSOLogin.
+// The token is refreshed with the RefreshToken of t before it expires, it is set as Config.TokenSource.
+func TenantTokenSource(t Tenant, login *SSOLoginRsp) client.TokenSource {
+	return client.NewTokenSource(login.token(), func(ctx context.Context, current client.Token) (client.Token, error) {
+		rsp, err := t.RefreshToken(ctx, current.Value)
+		if err != nil {
+			return client.Token{}, err
+		}
+		return rsp.token(), nil
+	})
 }
 
 // SSOLogin login sub account user, if user not exist, will create the account automatically
@@ -78,31 +120,11 @@ func (t *tenant) SSOLogin(ctx context.Context, req SubUserInfo) (*SSOLoginRsp, e
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("tenant-api-key", t.tenantKey)
-	rsp, err := t.client.Do(request)
-	if err != nil {
-		return nil, err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
+	ret, err := t.do(request)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := &client.Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return nil, err
-	}
-
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	ssoLoginRsp := &SSOLoginRsp{}
 	err = interfaceToStruct(ret.Data, ssoLoginRsp)
 	if err != nil {
@@ -128,31 +150,10 @@ func (t *tenant) SyncUser(ctx context.Context, req SubUserInfo) error {
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("tenant-api-key", t.tenantKey)
-	rsp, err := t.client.Do(request)
-	if err != nil {
-		return err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
-
-	ret := &client.Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
+	if _, err := t.do(request); err != nil {
 		return err
 	}
 
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	return nil
 }
 
@@ -167,31 +168,10 @@ func (t *tenant) DeleteUser(ctx context.Context, entryUUID string, withAssets bo
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("tenant-api-key", t.tenantKey)
-	rsp, err := t.client.Do(request)
-	if err != nil {
-		return err
-	}
-
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return err
-	}
-
-	ret := &client.Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
+	if _, err := t.do(request); err != nil {
 		return err
 	}
 
-	if ret.Code != 0 {
-		return fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	return nil
 }
 
@@ -206,31 +186,11 @@ func (t *tenant) RefreshToken(ctx context.Context, token string) (*SSOLoginRsp,
 
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("tenant-api-key", t.tenantKey)
-	rsp, err := t.client.Do(request)
+	ret, err := t.do(request)
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.StatusCode != http.StatusOK {
-		buf, _ := io.ReadAll(rsp.Body)
-		return nil, fmt.Errorf("status code %d, %s", rsp.StatusCode, string(buf))
-	}
-
-	body, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &client.Result{}
-	err = json.Unmarshal(body, ret)
-	if err != nil {
-		return nil, err
-	}
-
-	if ret.Code != 0 {
-		return nil, fmt.Errorf(fmt.Sprintf("code: %d, err: %d, msg: %s", ret.Code, ret.Err, ret.Msg))
-	}
-
 	ssoLoginRsp := &SSOLoginRsp{}
 	err = interfaceToStruct(ret.Data, ssoLoginRsp)
 	if err != nil {
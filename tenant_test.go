@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+func TestNewTenantRejectsIgnoredOptions(t *testing.T) {
+	if _, err := NewTenant("http://titan", "key", client.WithHTTPClient(http.DefaultClient), client.WithMiddleware(client.UserAgent("sdk"))); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, option := range map[string]client.Option{
+		"token source": client.WithTokenSource(client.NewTokenSource(client.Token{Value: "token"}, nil)),
+		"retry policy": client.WithRetryPolicy(client.DefaultRetryPolicy),
+	} {
+		if _, err := NewTenant("http://titan", "key", option); err == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+}
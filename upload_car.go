@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/raw"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// UploadCar uploads a CARv1 or CARv2 built by other tools.
+// The car must have a single root, every block must hash to its CID and the dag under the root must be complete,
+// otherwise nothing is registered. r is read twice, readers without random access are spooled to a temporary file.
+// If name is empty, name will be the root CID.
+func (s *storage) UploadCar(ctx context.Context, r io.Reader, name string, progress ProgressFunc, options ...RequestOption) (cid.Cid, error) {
+	opts := newRequestOptions(client.AssetProperty{NodeID: s.candidateID, GroupID: s.groupID}, options)
+	if opts.Encrypted {
+		return cid.Cid{}, fmt.Errorf("encryption of a car is not supported")
+	}
+
+	source, err := newReplayableSource(r)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer source.Close()
+
+	root, assetType, err := validateCar(source.Open())
+	if err != nil {
+		return cid.Cid{}, fmt.Errorf("invalid car: %w", err)
+	}
+
+	if len(name) == 0 {
+		name = root.String()
+	}
+
+	opts.AssetCID = root.String()
+	opts.AssetName = name
+	opts.AssetSize = source.Size()
+	opts.AssetType = assetType
+
+	return s.registerAndUpload(ctx, root, opts, func() (io.ReadCloser, error) {
+		return io.NopCloser(source.Open()), nil
+	}, progress)
+}
+
+// registerAsset registers the asset of opts for its upload, unless the dedup policy of opts skips the upload.
+// It returns the endpoints to upload the car to, none when the content does not have to be uploaded.
+func (s *storage) registerAsset(ctx context.Context, opts *requestOptions) ([]*client.Endpoint, error) {
+	skip, rsp, err := s.skipUpload(ctx, opts)
+	if err != nil || skip {
+		return nil, err
+	}
+
+	// the asset registered by the dedup policy is not registered twice
+	if rsp == nil {
+		req := client.CreateAssetReq{AssetProperty: opts.AssetProperty, AreaIDs: s.areas}
+		if rsp, err = s.webAPI.CreateAsset(ctx, &req); err != nil {
+			return nil, fmt.Errorf("CreateAsset error %w", err)
+		}
+	}
+
+	if rsp.IsAlreadyExist {
+		return nil, nil
+	}
+
+	if len(rsp.Endpoints) == 0 {
+		return nil, fmt.Errorf("endpoints is empty")
+	}
+
+	return rsp.Endpoints, nil
+}
+
+// registerAndUpload registers the asset described by opts and uploads its car, open returns a new reader of the car.
+// The asset is deleted from titan if the upload does not reach the quorum.
+func (s *storage) registerAndUpload(ctx context.Context, root cid.Cid, opts *requestOptions, open func() (io.ReadCloser, error), progress ProgressFunc) (cid.Cid, error) {
+	endpoints, err := s.registerAsset(ctx, opts)
+	if err != nil {
+		return cid.Cid{}, err
+	} else if len(endpoints) == 0 {
+		return root, nil
+	}
+
+	u := &replicaUpload{
+		root:     root,
+		name:     opts.AssetName,
+		size:     opts.AssetSize,
+		open:     open,
+		replicas: opts.replicas,
+		quorum:   opts.quorum,
+	}
+
+	if _, err = s.uploadReplicas(ctx, endpoints, u, progress); err != nil {
+		if delErr := s.webAPI.DeleteAsset(ctx, s.userID, root.String()); delErr != nil {
+			return cid.Cid{}, fmt.Errorf("uploadFileWithForm failed %s, delete error %s", err.Error(), delErr.Error())
+		}
+		return cid.Cid{}, err
+	}
+
+	return root, nil
+}
+
+// validateCar checks that the car read from r has a single root, that every block hashes to its CID
+// and that every block linked from the root is in the car.
+// It returns the root and whether the root is a unixfs file or folder.
+func validateCar(r io.Reader) (cid.Cid, string, error) {
+	// the block reader verifies the hash of every block
+	br, err := car.NewBlockReader(r)
+	if err != nil {
+		return cid.Cid{}, "", err
+	}
+
+	if len(br.Roots) != 1 {
+		return cid.Cid{}, "", fmt.Errorf("car has %d roots, expected 1", len(br.Roots))
+	}
+	root := br.Roots[0]
+
+	// links of every block, keyed by multihash like a blockstore
+	links := make(map[string][]cid.Cid)
+	assetType := string(FileTypeFile)
+
+	for {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return cid.Cid{}, "", err
+		}
+
+		node, err := decodeBlock(blk.Cid(), blk.RawData())
+		if err != nil {
+			return cid.Cid{}, "", fmt.Errorf("decode block %s: %w", blk.Cid(), err)
+		}
+
+		blockLinks, err := traversal.SelectLinks(node)
+		if err != nil {
+			return cid.Cid{}, "", err
+		}
+
+		cids := make([]cid.Cid, 0, len(blockLinks))
+		for _, l := range blockLinks {
+			if cl, ok := l.(cidlink.Link); ok {
+				cids = append(cids, cl.Cid)
+			}
+		}
+		links[string(blk.Cid().Hash())] = cids
+
+		if blk.Cid().Equals(root) && isDirectory(node) {
+			assetType = string(FileTypeFolder)
+		}
+	}
+
+	// walk the dag from the root, every linked block must be in the car
+	visited := make(map[string]struct{})
+	queue := []cid.Cid{root}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		// identity CIDs carry their data, they have no block
+		if c.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+
+		key := string(c.Hash())
+		if _, ok := visited[key]; ok {
+			continue
+		}
+		visited[key] = struct{}{}
+
+		children, ok := links[key]
+		if !ok {
+			return cid.Cid{}, "", fmt.Errorf("dag is incomplete, block %s is missing", c)
+		}
+		queue = append(queue, children...)
+	}
+
+	return root, assetType, nil
+}
+
+// decodeBlock decodes a block of the codecs found in unixfs and ipld dags
+func decodeBlock(c cid.Cid, b []byte) (datamodel.Node, error) {
+	var (
+		nb     datamodel.NodeBuilder
+		decode func(datamodel.NodeAssembler, io.Reader) error
+	)
+
+	switch multicodec.Code(c.Prefix().Codec) {
+	case multicodec.DagPb:
+		nb, decode = dagpb.Type.PBNode.NewBuilder(), dagpb.Decode
+	case multicodec.Raw:
+		nb, decode = basicnode.Prototype.Bytes.NewBuilder(), raw.Decode
+	case multicodec.DagCbor:
+		nb, decode = basicnode.Prototype.Any.NewBuilder(), dagcbor.Decode
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", multicodec.Code(c.Prefix().Codec))
+	}
+
+	if err := decode(nb, bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// isDirectory reports whether node is a unixfs directory
+func isDirectory(node datamodel.Node) bool {
+	pbNode, ok := node.(dagpb.PBNode)
+	if !ok || !pbNode.FieldData().Exists() {
+		return false
+	}
+
+	ufsData, err := data.DecodeUnixFSData(pbNode.FieldData().Must().Bytes())
+	if err != nil {
+		return false
+	}
+
+	dataType := ufsData.FieldDataType().Int()
+	return dataType == data.Data_Directory || dataType == data.Data_HAMTShard
+}
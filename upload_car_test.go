@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	carv1 "github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/ipld/go-car/v2"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// buildCarV1 returns the CARv1 of content
+func buildCarV1(t *testing.T, content []byte) []byte {
+	root, _, err := calculateCarV1(bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCarV1(bytes.NewReader(content), root, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// dropBlock returns the car without its index-th block
+func dropBlock(t *testing.T, b []byte, index int) []byte {
+	br, err := car.NewBlockReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := carv1.WriteHeader(&carv1.CarHeader{Roots: br.Roots, Version: 1}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == index {
+			continue
+		}
+		if err := util.LdWrite(&buf, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestUploadCar(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	valid := buildCarV1(t, content)
+
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: srv.URL}}}
+	s := &storage{webAPI: web}
+
+	root, err := s.UploadCar(context.Background(), bytes.NewReader(valid), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(web.created) != 1 || web.created[0].AssetCID != root.String() || web.created[0].AssetType != string(FileTypeFile) || web.created[0].AssetSize != int64(len(valid)) {
+		t.Fatalf("unexpected asset %+v", web.created)
+	}
+	if len(uploads) != 1 || !bytes.Equal(uploads[0], valid) {
+		t.Fatal("uploaded car differs")
+	}
+
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	for name, b := range map[string][]byte{
+		"corrupted block": corrupted,
+		"missing block":   dropBlock(t, valid, 1),
+	} {
+		if _, err := s.UploadCar(context.Background(), bytes.NewReader(b), "", nil); err == nil {
+			t.Fatalf("%s: car was uploaded", name)
+		}
+	}
+
+	if len(web.created) != 1 {
+		t.Fatal("invalid car was registered")
+	}
+}
+
+func TestUploadCarV2Folder(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("titan"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	carPath := filepath.Join(t.TempDir(), "folder.car")
+	root, err := createCar(dir, carPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var uploads [][]byte
+	srv := newUploadServer(t, http.StatusOK, &uploads)
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: srv.URL}}}
+	s := &storage{webAPI: web}
+
+	got, err := s.UploadCar(context.Background(), f, "folder", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Equals(root) || web.created[0].AssetType != string(FileTypeFolder) {
+		t.Fatalf("got %s %+v, expected folder %s", got, web.created[0], root)
+	}
+}
@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+const (
+	sessionStateSuffix = ".json"
+	sessionCarSuffix   = ".car"
+	// sessionMACKeyFile holds the key of the content MACs of the encrypted sessions, wrapped by the KeyProvider
+	sessionMACKeyFile = "content-mac.key"
+)
+
+// UploadSession records the progress of a resumable upload in a local state file.
+// The session is keyed by the root CID of the car, so an interrupted process
+// can continue the upload without building the car or registering the asset again.
+type UploadSession struct {
+	Root          string               `json:"root"`
+	CarPath       string               `json:"car_path"`
+	AssetProperty client.AssetProperty `json:"asset_property"`
+	AreaIDs       []string             `json:"area_ids"`
+	// Replicas and Quorum are the settings of WithReplicas and WithQuorum
+	Replicas int `json:"replicas"`
+	Quorum   int `json:"quorum"`
+	// Registered is true once the asset is created on the scheduler
+	Registered bool               `json:"registered"`
+	Endpoints  []*client.Endpoint `json:"endpoints"`
+	// ContentMAC identifies the plain content of an encrypted session,
+	// whose root changes with the data key every time the content is encrypted.
+	// It is keyed by a key wrapped by the KeyProvider, so it does not reveal the content.
+	ContentMAC string `json:"content_mac,omitempty"`
+	// Uploaded are the candidate addresses of the endpoints that stored the car,
+	// they count towards the quorum of the next attempt
+	Uploaded []string `json:"uploaded,omitempty"`
+	// Failed maps the candidate address of an endpoint to its last upload error
+	Failed    map[string]string `json:"failed"`
+	Done      bool              `json:"done"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// StartUploadSession builds the car of a file, folder or stream into the session directory
+// and persists an upload session keyed by its root CID.
+// If a session for the same content already exists, the existing session is returned.
+// An encrypted session is found by the MAC of its plain content and keeps the data key it was started with,
+// so starting it again does not encrypt the content with a new data key.
+func (s *storage) StartUploadSession(ctx context.Context, filePath string, reader io.Reader, name string, options ...RequestOption) (*UploadSession, error) {
+	if err := os.MkdirAll(s.sessionDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	opts := newRequestOptions(client.AssetProperty{NodeID: s.candidateID, GroupID: s.groupID}, options)
+
+	var mac string
+	if opts.Encrypted {
+		// the car is made of the encrypted content, which is always a stream
+		if filePath != "" && len(name) == 0 {
+			name = filepath.Base(filePath)
+		}
+
+		source, release, err := openPlainContent(filePath, reader)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		if kp := s.requestKeyProvider(opts); kp != nil {
+			if mac, err = s.sessionContentMAC(ctx, kp, source, opts.dag); err != nil {
+				return nil, err
+			}
+		}
+
+		if mac != "" {
+			if session, err := s.findEncryptedSession(ctx, mac); err != nil || session != nil {
+				return session, err
+			}
+		}
+
+		enc, err := s.encryptor(ctx, opts, source.Size())
+		if err != nil {
+			return nil, err
+		}
+
+		filePath, reader = "", enc.Reader(source.Open())
+	}
+
+	tempFile, err := os.CreateTemp(s.sessionDir, "car-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	var (
+		root      cid.Cid
+		assetType = string(FileTypeFile)
+	)
+
+	switch {
+	case filePath != "":
+		if err = tempFile.Close(); err != nil {
+			return nil, err
+		}
+		// blockstore.OpenReadWrite refuses to resume a car that is not a valid one
+		if err = os.Remove(tempPath); err != nil {
+			return nil, err
+		}
+		if assetType, err = getFileType(filePath); err != nil {
+			return nil, err
+		}
+		if root, err = createCar(filePath, tempPath, opts.dag); err != nil {
+			return nil, err
+		}
+		if len(name) == 0 {
+			name = filepath.Base(filePath)
+		}
+	case reader != nil:
+		root, err = createCarStream(reader, tempFile, opts.dag)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		tempFile.Close()
+		return nil, fmt.Errorf("FilePath or Reader must be non empty")
+	}
+
+	if len(name) == 0 {
+		name = root.String()
+	}
+
+	if session, err := s.loadUploadSession(root.String()); err == nil {
+		return session, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	carPath := filepath.Join(s.sessionDir, root.String()+sessionCarSuffix)
+	if err = os.Rename(tempPath, carPath); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(carPath)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.AssetCID = root.String()
+	opts.AssetName = name
+	opts.AssetSize = fileInfo.Size()
+	opts.AssetType = assetType
+
+	session := &UploadSession{
+		Root:          root.String(),
+		CarPath:       carPath,
+		AssetProperty: opts.AssetProperty,
+		AreaIDs:       s.areas,
+		Replicas:      opts.replicas,
+		Quorum:        opts.quorum,
+		ContentMAC:    mac,
+		Failed:        make(map[string]string),
+	}
+
+	if err = s.saveUploadSession(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ResumeUploadSession continues the upload session of rootCID from its last persisted state.
+// Endpoints that already stored the car count towards the quorum and are not sent it again,
+// endpoints that already failed are skipped; when every known endpoint has failed,
+// the asset is registered again to get fresh endpoints from the scheduler.
+// The L1 upload handler accepts the car in a single request, so each endpoint
+// attempt sends the car from its beginning.
+func (s *storage) ResumeUploadSession(ctx context.Context, rootCID string, progress ProgressFunc) (cid.Cid, error) {
+	session, err := s.loadUploadSession(rootCID)
+	if err != nil {
+		return cid.Cid{}, fmt.Errorf("load upload session %s: %w", rootCID, err)
+	}
+
+	root, err := cid.Decode(session.Root)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+
+	if session.Done {
+		return root, s.removeUploadSession(session)
+	}
+
+	carFile, err := os.Open(session.CarPath)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	defer carFile.Close()
+
+	for refreshed := false; ; refreshed = true {
+		if !session.Registered {
+			if err := s.registerUploadSession(ctx, session); err != nil {
+				return cid.Cid{}, err
+			}
+		}
+
+		if session.Done {
+			return root, s.removeUploadSession(session)
+		}
+
+		var endpoints []*client.Endpoint
+		for _, ep := range session.Endpoints {
+			if _, ok := session.Failed[ep.CandidateAddr]; !ok && !slices.Contains(session.Uploaded, ep.CandidateAddr) {
+				endpoints = append(endpoints, ep)
+			}
+		}
+
+		quorum := session.Quorum - len(session.Uploaded)
+		if len(endpoints) >= quorum {
+			u := &replicaUpload{
+				root: root,
+				name: session.AssetProperty.AssetName,
+				size: session.AssetProperty.AssetSize,
+				open: func() (io.ReadCloser, error) {
+					return io.NopCloser(io.NewSectionReader(carFile, 0, session.AssetProperty.AssetSize)), nil
+				},
+				replicas: session.Replicas - len(session.Uploaded),
+				quorum:   quorum,
+			}
+
+			outcomes, err := s.uploadReplicas(ctx, endpoints, u, progress)
+			if err == nil {
+				session.Done = true
+				if err := s.saveUploadSession(session); err != nil {
+					log.Printf("save upload session %s error %s", session.Root, err.Error())
+				}
+				return root, s.removeUploadSession(session)
+			}
+
+			for addr, uploadErr := range outcomes {
+				if uploadErr == nil {
+					session.Uploaded = append(session.Uploaded, addr)
+				}
+			}
+
+			// an interrupted upload is not a failure of the endpoints
+			if ctx.Err() != nil {
+				if err := s.saveUploadSession(session); err != nil {
+					log.Printf("save upload session %s error %s", session.Root, err.Error())
+				}
+				return cid.Cid{}, ctx.Err()
+			}
+
+			log.Printf("upload session %s error %s", session.Root, err.Error())
+			for addr, uploadErr := range outcomes {
+				if uploadErr != nil {
+					session.Failed[addr] = uploadErr.Error()
+				}
+			}
+			if err := s.saveUploadSession(session); err != nil {
+				return cid.Cid{}, err
+			}
+		}
+
+		if refreshed {
+			break
+		}
+
+		// every known endpoint failed, release the asset and ask the scheduler for fresh ones
+		if err := s.webAPI.DeleteAsset(ctx, s.userID, session.Root); err != nil {
+			return cid.Cid{}, fmt.Errorf("delete asset %s error %w", session.Root, err)
+		}
+
+		session.Registered = false
+		session.Endpoints = nil
+		session.Uploaded = nil
+		session.Failed = make(map[string]string)
+		if err := s.saveUploadSession(session); err != nil {
+			return cid.Cid{}, err
+		}
+	}
+
+	return cid.Cid{}, fmt.Errorf("upload session %s failed on every endpoint", rootCID)
+}
+
+// AbortUploadSession removes the upload session of rootCID and its car.
+// The asset is deleted from titan if it was registered but not uploaded.
+func (s *storage) AbortUploadSession(ctx context.Context, rootCID string) error {
+	session, err := s.loadUploadSession(rootCID)
+	if err != nil {
+		return fmt.Errorf("load upload session %s: %w", rootCID, err)
+	}
+
+	if session.Registered && !session.Done {
+		if err := s.webAPI.DeleteAsset(ctx, s.userID, session.Root); err != nil {
+			return fmt.Errorf("delete asset %s error %w", session.Root, err)
+		}
+	}
+
+	return s.removeUploadSession(session)
+}
+
+// ListUploadSessions returns the upload sessions persisted in the session directory.
+func (s *storage) ListUploadSessions(ctx context.Context) ([]*UploadSession, error) {
+	entries, err := os.ReadDir(s.sessionDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sessions := make([]*UploadSession, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), sessionStateSuffix) {
+			continue
+		}
+
+		session, err := s.loadUploadSession(strings.TrimSuffix(entry.Name(), sessionStateSuffix))
+		if err != nil {
+			log.Printf("load upload session %s error %s", entry.Name(), err.Error())
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// sessionContentMAC returns the MAC of the plain content of an encrypted session.
+// It is empty if the key of the session directory is wrapped by another KeyProvider, the session is then not reused.
+func (s *storage) sessionContentMAC(ctx context.Context, kp KeyProvider, source contentSource, dag *DagOptions) (string, error) {
+	key, err := s.sessionMACKey(ctx, kp)
+	if err != nil {
+		log.Printf("content MAC key of %s error %s, the encrypted session is not reused", s.sessionDir, err.Error())
+		return "", nil
+	}
+
+	return plainContentMAC(key, source, dag)
+}
+
+// sessionMACKey returns the key of the content MACs of the session directory,
+// it is created and stored wrapped by kp the first time
+func (s *storage) sessionMACKey(ctx context.Context, kp KeyProvider) ([]byte, error) {
+	var stored struct {
+		KeyID   string `json:"key_id"`
+		Wrapped []byte `json:"wrapped"`
+	}
+
+	keyPath := filepath.Join(s.sessionDir, sessionMACKeyFile)
+	b, err := os.ReadFile(keyPath)
+	if err == nil {
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", keyPath, err)
+		}
+		return kp.UnwrapKey(ctx, stored.KeyID, stored.Wrapped)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if stored.KeyID, stored.Wrapped, err = kp.WrapKey(ctx, key); err != nil {
+		return nil, fmt.Errorf("wrap content MAC key: %w", err)
+	}
+
+	if b, err = json.Marshal(stored); err != nil {
+		return nil, err
+	}
+
+	tempPath := keyPath + ".tmp"
+	if err := os.WriteFile(tempPath, b, 0o600); err != nil {
+		return nil, err
+	}
+
+	return key, os.Rename(tempPath, keyPath)
+}
+
+// findEncryptedSession returns the encrypted session of the plain content MAC, or nil if there is none
+func (s *storage) findEncryptedSession(ctx context.Context, mac string) (*UploadSession, error) {
+	sessions, err := s.ListUploadSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		if session.ContentMAC == mac {
+			return session, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// registerUploadSession creates the asset of the session and records the endpoints returned by the scheduler
+func (s *storage) registerUploadSession(ctx context.Context, session *UploadSession) error {
+	req := client.CreateAssetReq{AssetProperty: session.AssetProperty, AreaIDs: session.AreaIDs}
+	rsp, err := s.webAPI.CreateAsset(ctx, &req)
+	if err != nil {
+		return fmt.Errorf("CreateAsset error %w", err)
+	}
+
+	if !rsp.IsAlreadyExist && len(rsp.Endpoints) == 0 {
+		return fmt.Errorf("endpoints is empty")
+	}
+
+	session.Registered = true
+	session.Done = rsp.IsAlreadyExist
+	session.Endpoints = rsp.Endpoints
+	session.Uploaded = nil
+	session.Failed = make(map[string]string)
+
+	return s.saveUploadSession(session)
+}
+
+func (s *storage) uploadSessionStatePath(rootCID string) string {
+	return filepath.Join(s.sessionDir, rootCID+sessionStateSuffix)
+}
+
+func (s *storage) loadUploadSession(rootCID string) (*UploadSession, error) {
+	b, err := os.ReadFile(s.uploadSessionStatePath(rootCID))
+	if err != nil {
+		return nil, err
+	}
+
+	session := &UploadSession{}
+	if err := json.Unmarshal(b, session); err != nil {
+		return nil, fmt.Errorf("decode upload session %s: %w", rootCID, err)
+	}
+
+	if session.Failed == nil {
+		session.Failed = make(map[string]string)
+	}
+
+	// sessions saved before replicas were supported
+	if session.Quorum < 1 {
+		session.Quorum = 1
+	}
+	if session.Replicas < session.Quorum {
+		session.Replicas = session.Quorum
+	}
+
+	return session, nil
+}
+
+// saveUploadSession writes the session state to a temporary file and renames it,
+// so a crash never leaves a truncated state file behind
+func (s *storage) saveUploadSession(session *UploadSession) error {
+	session.UpdatedAt = time.Now()
+
+	b, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := s.uploadSessionStatePath(session.Root)
+	tempPath := statePath + ".tmp"
+	if err := os.WriteFile(tempPath, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, statePath)
+}
+
+func (s *storage) removeUploadSession(session *UploadSession) error {
+	if err := os.Remove(session.CarPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(s.uploadSessionStatePath(session.Root)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
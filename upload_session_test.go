@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/utopiosphe/titan-storage-sdk/client"
+)
+
+// fakeWebserver implements the scheduler calls used by uploads, the rest of client.Webserver panics
+type fakeWebserver struct {
+	client.Webserver
+
+	mu        sync.Mutex
+	endpoints []*client.Endpoint
+	created   []client.CreateAssetReq
+	deleted   []string
+	reports   []client.AssetTransferReq
+	groups    []*client.AssetGroup
+	// uploadURL is the node returned by GetNodeUploadInfo
+	uploadURL string
+	// owned are the CIDs of the assets returned by ListAssets
+	owned []string
+	// moved are the CIDs of the assets moved with MoveAssetToGroup
+	moved []string
+	// lists is the number of calls to ListGroups
+	lists int
+}
+
+func (f *fakeWebserver) CreateAsset(ctx context.Context, req *client.CreateAssetReq) (*client.CreateAssetRsp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, *req)
+	return &client.CreateAssetRsp{Endpoints: f.endpoints}, nil
+}
+
+func (f *fakeWebserver) DeleteAsset(ctx context.Context, userID, assetCID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, assetCID)
+	return nil
+}
+
+func (f *fakeWebserver) GetNodeUploadInfo(ctx context.Context, userID, area string, urlMode bool) (*client.UploadInfo, error) {
+	return &client.UploadInfo{List: []*client.NodeUploadInfo{{UploadURL: f.uploadURL}}}, nil
+}
+
+func (f *fakeWebserver) GetNodeUploadInfoWithOptions(ctx context.Context, userID string, opts client.UploadInfoOptions) (*client.UploadInfo, error) {
+	return f.GetNodeUploadInfo(ctx, userID, opts.Area, opts.URLMode)
+}
+
+func (f *fakeWebserver) CreateGroup(ctx context.Context, name string, parent int) (*client.AssetGroup, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	group := &client.AssetGroup{ID: len(f.groups) + 1, Name: name, Parent: parent}
+	f.groups = append(f.groups, group)
+	return group, nil
+}
+
+func (f *fakeWebserver) ListGroups(ctx context.Context, parent, pageSize, page int) (*client.ListAssetGroupRsp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	rsp := &client.ListAssetGroupRsp{}
+	for _, group := range f.groups {
+		if group.Parent == parent {
+			rsp.AssetGroups = append(rsp.AssetGroups, group)
+		}
+	}
+	rsp.Total = len(rsp.AssetGroups)
+	return rsp, nil
+}
+
+func (f *fakeWebserver) ListAssets(ctx context.Context, parent, pageSize, page int, cid string, folderID int) (*client.ListAssetRecordRsp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rsp := &client.ListAssetRecordRsp{}
+	for _, owned := range f.owned {
+		if cid == "" || cid == owned {
+			rsp.AssetOverviews = append(rsp.AssetOverviews, &client.AssetOverview{AssetRecord: &client.AssetRecord{CID: owned}})
+		}
+	}
+	rsp.Total = len(rsp.AssetOverviews)
+	return rsp, nil
+}
+
+func (f *fakeWebserver) AssetTransferReport(ctx context.Context, req client.AssetTransferReq) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reports = append(f.reports, req)
+	return nil
+}
+
+// uploadsMu guards the uploads recorded by servers that receive concurrent uploads
+var uploadsMu sync.Mutex
+
+// newUploadServer returns a L1 upload endpoint answering with status, and records the uploaded files
+func newUploadServer(t *testing.T, status int, uploads *[][]byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("read form file: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		uploadsMu.Lock()
+		*uploads = append(*uploads, b)
+		uploadsMu.Unlock()
+
+		json.NewEncoder(w).Encode(UploadFileResult{Cid: "bafkreibcyimvlzbgwudx3oict7iufabktjherbhkopwaxzobukpc2bricq"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestUploadSessionResume(t *testing.T) {
+	var uploads [][]byte
+	failing := newUploadServer(t, http.StatusInternalServerError, nil)
+	working := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{endpoints: []*client.Endpoint{{CandidateAddr: failing.URL}}}
+	s := &storage{webAPI: web, sessionDir: t.TempDir()}
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+
+	session, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt", WithGroupID(7))
+	if err != nil {
+		t.Fatal("StartUploadSession ", err)
+	}
+
+	if session.AssetProperty.GroupID != 7 || session.AssetProperty.AssetName != "titan.txt" {
+		t.Fatalf("unexpected asset property %+v", session.AssetProperty)
+	}
+
+	again, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt")
+	if err != nil {
+		t.Fatal("StartUploadSession again ", err)
+	}
+	if again.Root != session.Root {
+		t.Fatalf("same content should resolve to the same session, %s != %s", again.Root, session.Root)
+	}
+
+	// the only endpoint fails, the session is re-registered and fails again
+	if _, err := s.ResumeUploadSession(ctx, session.Root, nil); err == nil {
+		t.Fatal("expect resume to fail while every endpoint is down")
+	}
+	if len(web.deleted) != 1 || len(web.created) != 2 {
+		t.Fatalf("expect one release and two registrations, got %d and %d", len(web.deleted), len(web.created))
+	}
+
+	sessions, err := s.ListUploadSessions(ctx)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expect one pending session, got %d, %v", len(sessions), err)
+	}
+	if !sessions[0].Registered || len(sessions[0].Failed) != 1 {
+		t.Fatalf("unexpected persisted state %+v", sessions[0])
+	}
+
+	// a fresh endpoint becomes available, the next resume picks it up
+	web.endpoints = []*client.Endpoint{{CandidateAddr: working.URL}}
+	root, err := s.ResumeUploadSession(ctx, session.Root, nil)
+	if err != nil {
+		t.Fatal("ResumeUploadSession ", err)
+	}
+	if root.String() != session.Root {
+		t.Fatalf("unexpected root %s", root.String())
+	}
+	if len(uploads) != 1 || int64(len(uploads[0])) != session.AssetProperty.AssetSize {
+		t.Fatalf("expect the whole car to be uploaded once")
+	}
+
+	if sessions, _ := s.ListUploadSessions(ctx); len(sessions) != 0 {
+		t.Fatalf("finished session should be removed")
+	}
+}
+
+func TestAbortUploadSession(t *testing.T) {
+	web := &fakeWebserver{}
+	s := &storage{webAPI: web, sessionDir: t.TempDir()}
+
+	filePath := filepath.Join(t.TempDir(), "abort.txt")
+	if err := os.WriteFile(filePath, []byte("abort me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	session, err := s.StartUploadSession(ctx, filePath, nil, "")
+	if err != nil {
+		t.Fatal("StartUploadSession ", err)
+	}
+
+	if session.AssetProperty.AssetName != "abort.txt" || session.AssetProperty.AssetType != string(FileTypeFile) {
+		t.Fatalf("unexpected asset property %+v", session.AssetProperty)
+	}
+
+	if err := s.AbortUploadSession(ctx, session.Root); err != nil {
+		t.Fatal("AbortUploadSession ", err)
+	}
+
+	if len(web.deleted) != 0 {
+		t.Fatalf("unregistered session should not delete the asset")
+	}
+
+	if _, err := s.ResumeUploadSession(ctx, session.Root, nil); err == nil {
+		t.Fatal("aborted session should not be resumable")
+	}
+}
+
+func TestEncryptedUploadSessionReusesDataKey(t *testing.T) {
+	s := &storage{webAPI: &fakeWebserver{}, sessionDir: t.TempDir(), keyProvider: testKeyProvider(t)}
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+
+	session, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt", WithEncryption(nil))
+	if err != nil {
+		t.Fatal("StartUploadSession ", err)
+	}
+	if !session.AssetProperty.Encrypted || session.ContentMAC == "" {
+		t.Fatalf("unexpected encrypted session %+v", session)
+	}
+
+	// the session state does not hold a plain hash of the content
+	state, err := os.ReadFile(s.uploadSessionStatePath(session.Root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag, _ := json.Marshal((*DagOptions)(nil))
+	sum := sha256.Sum256(append(dag, content...))
+	if bytes.Contains(state, []byte(hex.EncodeToString(sum[:]))) {
+		t.Fatal("session state holds the sha256 of the plain content")
+	}
+
+	car, err := os.ReadFile(session.CarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt", WithEncryption(nil))
+	if err != nil {
+		t.Fatal("StartUploadSession again ", err)
+	}
+	if again.Root != session.Root {
+		t.Fatalf("same content should resolve to the same encrypted session, %s != %s", again.Root, session.Root)
+	}
+
+	// the car of the session is not encrypted again with a new data key
+	if b, err := os.ReadFile(again.CarPath); err != nil || !bytes.Equal(b, car) {
+		t.Fatalf("car of the session changed, %v", err)
+	}
+
+	other, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt", WithEncryption(nil), WithDagOptions(DagOptions{ChunkSize: 1 << 10, RawLeaves: true, CidVersion: 1}))
+	if err != nil {
+		t.Fatal("StartUploadSession with dag options ", err)
+	}
+	if other.Root == session.Root {
+		t.Fatal("other dag options should start another session")
+	}
+
+	if sessions, _ := s.ListUploadSessions(ctx); len(sessions) != 2 {
+		t.Fatalf("expect two sessions, got %d", len(sessions))
+	}
+}
+
+func TestUploadSessionResumeKeepsUploadedEndpoints(t *testing.T) {
+	var stored, uploads [][]byte
+	uploaded := newUploadServer(t, http.StatusOK, &stored)
+	pending := newUploadServer(t, http.StatusOK, &uploads)
+
+	web := &fakeWebserver{}
+	s := &storage{webAPI: web, sessionDir: t.TempDir()}
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("titan"), 1<<12)
+	session, err := s.StartUploadSession(ctx, "", bytes.NewReader(content), "titan.txt", WithReplicas(2), WithQuorum(2))
+	if err != nil {
+		t.Fatal("StartUploadSession ", err)
+	}
+
+	// a previous attempt was interrupted once the first endpoint stored the car
+	session.Registered = true
+	session.Endpoints = []*client.Endpoint{{CandidateAddr: uploaded.URL}, {CandidateAddr: pending.URL}}
+	session.Uploaded = []string{uploaded.URL}
+	if err := s.saveUploadSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ResumeUploadSession(ctx, session.Root, nil); err != nil {
+		t.Fatal("ResumeUploadSession ", err)
+	}
+
+	if len(stored) != 0 || len(uploads) != 1 {
+		t.Fatalf("expect the car to be sent to the pending endpoint only, got %d and %d uploads", len(stored), len(uploads))
+	}
+	if len(web.created) != 0 {
+		t.Fatalf("registered session should not be registered again")
+	}
+}
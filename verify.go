@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxBlockSize bounds the size of a block read by FetchBlockFromRoot for its verification
+const maxBlockSize = 4 << 20
+
+// DownloadOption customizes a download
+type DownloadOption func(*downloadOptions)
+
+// downloadOptions holds the download settings
+type downloadOptions struct {
+	// verify checks the downloaded content against the requested CID
+	verify bool
+	// dag rebuilds the dag of a verified file, nil infers it from the CID
+	dag *DagOptions
+	// car downloads the asset as a verified car
+	car bool
+	// progress reports the progress of a range download, it may be nil
+	progress DownloadProgressFunc
+}
+
+// newDownloadOptions applies options on top of the default download settings
+func newDownloadOptions(options []DownloadOption) *downloadOptions {
+	o := &downloadOptions{}
+	for _, opt := range options {
+		opt(o)
+	}
+	return o
+}
+
+// WithVerification checks that the downloaded content hashes to the requested CID.
+// A file is verified by rebuilding its dag while it is read, with dag, the options it was uploaded with.
+// If dag is nil, a CIDv0 is rebuilt like `ipfs add` and a CIDv1 with the default builder and the hash function of the CID.
+// Only file assets can be verified, the reader fails with an *IntegrityError instead of io.EOF if the content does not match,
+// so the content must not be trusted before the end of the reader.
+func WithVerification(dag *DagOptions) DownloadOption {
+	return func(o *downloadOptions) {
+		o.verify = true
+		o.dag = dag
+	}
+}
+
+// IntegrityError is returned when the downloaded content does not hash to the requested CID
+type IntegrityError struct {
+	// Expected is the requested CID
+	Expected cid.Cid
+	// Actual is the CID of the downloaded content
+	Actual cid.Cid
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed, content of %s hashes to %s", e.Expected, e.Actual)
+}
+
+// verifyDagOptions returns the options to rebuild the dag of root with, dag if it is set
+func verifyDagOptions(root cid.Cid, dag *DagOptions) *DagOptions {
+	if dag != nil {
+		return dag
+	}
+
+	if root.Version() == 0 {
+		return &DagOptions{}
+	}
+
+	if hash := root.Prefix().MhType; hash != multihash.SHA2_256 {
+		return &DagOptions{CidVersion: 1, RawLeaves: true, HashFunction: hash}
+	}
+
+	return nil
+}
+
+// verifyDownload wraps rc to verify the content against rootCID, rc is returned as is without WithVerification
+func verifyDownload(rootCID string, rc io.ReadCloser, opts *downloadOptions) (io.ReadCloser, error) {
+	if !opts.verify || rc == nil {
+		return rc, nil
+	}
+
+	root, err := cid.Decode(rootCID)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return newVerifyingReader(rc, root, verifyDagOptions(root, opts.dag)), nil
+}
+
+// verifyFile checks that the content of r hashes to rootCID, with the dag of opts
+func verifyFile(rootCID string, r io.Reader, opts *downloadOptions) error {
+	root, err := cid.Decode(rootCID)
+	if err != nil {
+		return err
+	}
+
+	actual, err := buildFile(r, func(cid.Cid, []byte) error { return nil }, verifyDagOptions(root, opts.dag))
+	if err != nil {
+		return err
+	}
+
+	if !actual.Equals(root) {
+		return &IntegrityError{Expected: root, Actual: actual}
+	}
+	return nil
+}
+
+// verifyBlock checks that data hashes to c
+func verifyBlock(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+
+	if !actual.Equals(c) {
+		return &IntegrityError{Expected: c, Actual: actual}
+	}
+	return nil
+}
+
+// readBlock reads and verifies the block c from r
+func readBlock(c cid.Cid, r io.Reader) (io.ReadCloser, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block %s is larger than %d bytes", c, maxBlockSize)
+	}
+
+	if err := verifyBlock(c, data); err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// verifyResult is the root rebuilt by a verifyingReader
+type verifyResult struct {
+	root cid.Cid
+	err  error
+}
+
+// verifyingReader rebuilds the dag of the content read through it,
+// and returns an *IntegrityError instead of io.EOF if the root is not the expected one
+type verifyingReader struct {
+	rc       io.ReadCloser
+	expected cid.Cid
+	pw       *io.PipeWriter
+	result   chan verifyResult
+	// err is returned by every Read once the content is verified or failed
+	err error
+}
+
+func newVerifyingReader(rc io.ReadCloser, expected cid.Cid, dag *DagOptions) *verifyingReader {
+	pr, pw := io.Pipe()
+	result := make(chan verifyResult, 1)
+
+	go func() {
+		root, err := buildFile(pr, func(cid.Cid, []byte) error { return nil }, dag)
+		// unblock the writes if the builder stopped early
+		pr.CloseWithError(errors.New("dag builder stopped"))
+		result <- verifyResult{root: root, err: err}
+	}()
+
+	return &verifyingReader{rc: rc, expected: expected, pw: pw, result: result}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.rc.Read(p)
+	if n > 0 {
+		if _, werr := v.pw.Write(p[:n]); werr != nil {
+			v.err = fmt.Errorf("verify content: %w", werr)
+			return n, v.err
+		}
+	}
+
+	switch {
+	case errors.Is(err, io.EOF):
+		v.pw.Close()
+		res := <-v.result
+		if res.err != nil {
+			v.err = fmt.Errorf("verify content: %w", res.err)
+		} else if !res.root.Equals(v.expected) {
+			v.err = &IntegrityError{Expected: v.expected, Actual: res.root}
+		} else {
+			v.err = io.EOF
+		}
+		return n, v.err
+	case err != nil:
+		v.pw.CloseWithError(err)
+		v.err = err
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	v.pw.CloseWithError(io.ErrClosedPipe)
+	return v.rc.Close()
+}
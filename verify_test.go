@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	content := make([]byte, 3<<20+5)
+	rand.Read(content)
+
+	tampered := append([]byte(nil), content...)
+	tampered[len(tampered)/2] ^= 1
+
+	for _, dag := range []*DagOptions{nil, {}, {CidVersion: 1, RawLeaves: true, HashFunction: multihash.BLAKE3}, {CidVersion: 1, Layout: DagTrickle}} {
+		var options []RequestOption
+		if dag != nil {
+			options = append(options, WithDagOptions(*dag))
+		}
+
+		root, err := CalculateCid(bytes.NewReader(content), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the trickle layout can not be inferred from the CID
+		verifyWith := (*DagOptions)(nil)
+		if dag != nil && dag.Layout == DagTrickle {
+			verifyWith = dag
+		}
+		opts := newDownloadOptions([]DownloadOption{WithVerification(verifyWith)})
+
+		rc, err := verifyDownload(root.String(), io.NopCloser(bytes.NewReader(content)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("%+v: %v", dag, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%+v: verified content differs", dag)
+		}
+
+		rc, err = verifyDownload(root.String(), io.NopCloser(bytes.NewReader(tampered)), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(rc)
+		var integrityErr *IntegrityError
+		if !errors.As(err, &integrityErr) || !integrityErr.Expected.Equals(root) {
+			t.Fatalf("%+v: expected an integrity error, got %v", dag, err)
+		}
+
+		if err := verifyFile(root.String(), bytes.NewReader(tampered), opts); !errors.As(err, &integrityErr) {
+			t.Fatalf("%+v: expected an integrity error for the file, got %v", dag, err)
+		}
+	}
+}
+
+func TestVerifyBlock(t *testing.T) {
+	data := []byte("titan block")
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := readBlock(c, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(rc); !bytes.Equal(got, data) {
+		t.Fatal("block content differs")
+	}
+
+	var integrityErr *IntegrityError
+	if _, err := readBlock(c, bytes.NewReader([]byte("other block"))); !errors.As(err, &integrityErr) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+}